@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -15,6 +26,33 @@ const (
 // "endless" bit array)
 type IntSet struct {
 	words []uint
+
+	// copy-on-write mode (see SetCopyOnWrite())
+	cow bool
+
+	// words is (or may be) shared with a copy: it must be
+	// cloned before being written to. Atomic, as Copy() sets
+	// it on a set which may be read (and copied) concurrently.
+	shared atomic.Bool
+}
+
+// In copy-on-write mode, Copy() is O(1): the copy shares its words
+// with the original, and whichever set is written to first clones
+// them. This is convenient for cheap (read-only) snapshots.
+//
+// NOTE: we don't keep track of how many sets share the words, so
+// both the original and the copy will clone them on their first
+// write, even if the other one is gone by then.
+func (s *IntSet) SetCopyOnWrite(on bool) {
+	s.cow = on
+}
+
+// Makes sure s.words isn't shared before writing to it.
+func (s *IntSet) own() {
+	if s.shared.Load() {
+		s.words = slices.Clone(s.words)
+		s.shared.Store(false)
+	}
 }
 
 func (s *IntSet) Has(x int) bool {
@@ -25,6 +63,7 @@ func (s *IntSet) Has(x int) bool {
 
 func (s *IntSet) Add(x int) {
 	word, bit := x/intLen, uint(x%intLen)
+	s.own()
 	for word >= len(s.words) {
 		s.words = append(s.words, 0)
 	}
@@ -32,6 +71,7 @@ func (s *IntSet) Add(x int) {
 }
 
 func (s *IntSet) UnionWith(t *IntSet) {
+	s.own()
 	for i, tword := range(t.words) {
 		if i < len(s.words) {
 			s.words[i] |= tword
@@ -83,16 +123,29 @@ func (s *IntSet) Remove(x int) {
 		return
 	}
 
+	s.own()
+
 	// FTR, "&^" is the so-called "bit clear" operator in Go.
 	s.words[word] &^= (1<<bit)
 }
 
 func (s *IntSet) Clear() {
 	s.words = make([]uint, 0)
+	s.shared.Store(false)
 }
 
+// NOTE: in copy-on-write mode, s is marked as shared; this is
+// done atomically, so that concurrent readers of s (e.g. of a
+// SyncIntSet's snapshot) can still copy it.
 func (s *IntSet) Copy() *IntSet {
-	t := &IntSet{make([]uint, len(s.words))}
+	if s.cow {
+		s.shared.Store(true)
+		t := &IntSet{words: s.words, cow: true}
+		t.shared.Store(true)
+		return t
+	}
+
+	t := &IntSet{words: make([]uint, len(s.words))}
 	for i := range s.words {
 		t.words[i] = s.words[i]
 	}
@@ -120,16 +173,23 @@ func (s *IntSet) Elems() []int {
 }
 
 func (s *IntSet) IntersectWith(t *IntSet) {
+	s.own()
 	for i, tword := range(t.words) {
 		if i < len(s.words) {
 			s.words[i] &= tword
 		}
 		// else, only in t, so clearly not in the intersection
 	}
+
+	// only in s, so clearly not in the intersection either
+	if len(s.words) > len(t.words) {
+		s.words = s.words[:len(t.words)]
+	}
 }
 
 // Elements which are in s but not in t
 func (s *IntSet) DifferenceWith(t *IntSet) {
+	s.own()
 	for i, tword := range(t.words) {
 		if i < len(s.words) {
 			s.words[i] &^= tword
@@ -140,6 +200,7 @@ func (s *IntSet) DifferenceWith(t *IntSet) {
 
 // Elements which are either only in s or only in t
 func (s *IntSet) SymmetricDifferenceWith(t *IntSet) {
+	s.own()
 	for i, tword := range(t.words) {
 		if i < len(s.words) {
 			s.words[i] ^= tword
@@ -151,8 +212,511 @@ func (s *IntSet) SymmetricDifferenceWith(t *IntSet) {
 	}
 }
 
+// Union returns a new set, containing elements which
+// are in at least one of the sets.
+func Union(sets ...*IntSet) *IntSet {
+	n := 0
+	for _, s := range sets {
+		n = max(n, len(s.words))
+	}
+
+	u := &IntSet{words: make([]uint, n)}
+	for _, s := range sets {
+		for i, word := range s.words {
+			u.words[i] |= word
+		}
+	}
+	return u
+}
+
+// Intersection returns a new set, containing elements which
+// are in all the sets; for no sets, this is the empty set.
+func Intersection(sets ...*IntSet) *IntSet {
+	if len(sets) == 0 {
+		return &IntSet{words: make([]uint, 0)}
+	}
+
+	n := len(sets[0].words)
+	for _, s := range sets[1:] {
+		n = min(n, len(s.words))
+	}
+
+	u := &IntSet{words: make([]uint, n)}
+	copy(u.words, sets[0].words)
+	for _, s := range sets[1:] {
+		for i := range u.words {
+			u.words[i] &= s.words[i]
+		}
+	}
+	return u
+}
+
+// Difference returns a new set, containing elements
+// which are in s, but in none of ts.
+func Difference(s *IntSet, ts ...*IntSet) *IntSet {
+	u := &IntSet{words: make([]uint, len(s.words))}
+	copy(u.words, s.words)
+	for _, t := range ts {
+		u.DifferenceWith(t)
+	}
+	return u
+}
+
+// SymmetricDifference returns a new set, containing
+// elements which are in an odd number of sets (for two
+// sets, that's the elements only in one of them).
+func SymmetricDifference(sets ...*IntSet) *IntSet {
+	n := 0
+	for _, s := range sets {
+		n = max(n, len(s.words))
+	}
+
+	u := &IntSet{words: make([]uint, n)}
+	for _, s := range sets {
+		for i, word := range s.words {
+			u.words[i] ^= word
+		}
+	}
+	return u
+}
+
+// Equal reports whether s and t have the same elements;
+// they may still have a different number of (zero) words.
+func (s *IntSet) Equal(t *IntSet) bool {
+	if len(s.words) < len(t.words) {
+		s, t = t, s
+	}
+	for i, word := range s.words {
+		var tword uint
+		if i < len(t.words) {
+			tword = t.words[i]
+		}
+		if word != tword {
+			return false
+		}
+	}
+	return true
+}
+
+// SubsetOf reports whether all the elements of s are in t.
+func (s *IntSet) SubsetOf(t *IntSet) bool {
+	for i, word := range s.words {
+		var tword uint
+		if i < len(t.words) {
+			tword = t.words[i]
+		}
+		if word&^tword != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Disjoint reports whether s and t have no elements in common.
+func (s *IntSet) Disjoint(t *IntSet) bool {
+	for i := range min(len(s.words), len(t.words)) {
+		if s.words[i]&t.words[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectionLen is Intersection(s, t).Len(), without
+// building the intersection.
+func (s *IntSet) IntersectionLen(t *IntSet) int {
+	n := 0
+	for i := range min(len(s.words), len(t.words)) {
+		n += bits.OnesCount(s.words[i] & t.words[i])
+	}
+	return n
+}
+
+// Makes sure s.words has at least n words.
+func (s *IntSet) grow(n int) {
+	if n > len(s.words) {
+		s.words = append(s.words, make([]uint, n-len(s.words))...)
+	}
+}
+
+// Calls f(i, mask) for each word i covering [lo, hi), mask
+// selecting the bits of the word within the range. lo is
+// clamped to 0.
+func forRange(lo, hi int, f func(i int, mask uint)) {
+	if lo < 0 {
+		lo = 0
+	}
+	if lo >= hi {
+		return
+	}
+
+	first, last := lo/intLen, (hi-1)/intLen
+	for i := first; i <= last; i++ {
+		mask := ^uint(0)
+		if i == first {
+			mask &= ^uint(0) << (lo % intLen)
+		}
+		if i == last && hi%intLen != 0 {
+			mask &= (1 << (hi % intLen)) - 1
+		}
+		f(i, mask)
+	}
+}
+
+// Adds all the elements of [lo, hi)
+func (s *IntSet) AddRange(lo, hi int) {
+	if lo >= hi {
+		return
+	}
+	s.own()
+	s.grow((hi-1)/intLen + 1)
+	forRange(lo, hi, func(i int, mask uint) {
+		s.words[i] |= mask
+	})
+}
+
+// Removes all the elements of [lo, hi)
+func (s *IntSet) RemoveRange(lo, hi int) {
+	// nothing to remove beyond that
+	hi = min(hi, len(s.words)*intLen)
+	if lo >= hi {
+		return
+	}
+	s.own()
+	forRange(lo, hi, func(i int, mask uint) {
+		s.words[i] &^= mask
+	})
+}
+
+// Complement flips [lo, hi): elements of the range which
+// were in s are removed, and the others are added.
+func (s *IntSet) Complement(lo, hi int) {
+	if lo >= hi {
+		return
+	}
+	s.own()
+	s.grow((hi-1)/intLen + 1)
+	forRange(lo, hi, func(i int, mask uint) {
+		s.words[i] ^= mask
+	})
+}
+
+// Flip removes x if it's in s, adds it otherwise.
+func (s *IntSet) Flip(x int) {
+	word, bit := x/intLen, uint(x%intLen)
+	s.own()
+	s.grow(word + 1)
+	s.words[word] ^= (1 << bit)
+}
+
+// All iterates on the elements of s, in increasing order.
+//
+// NOTE: s must not be modified while iterating.
+func (s *IntSet) All() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i, word := range s.words {
+			for word != 0 {
+				j := bits.TrailingZeros(word)
+				if !yield(i*intLen + j) {
+					return
+				}
+				word &^= 1 << j
+			}
+		}
+	}
+}
+
+// Backward iterates on the elements of s, in decreasing order.
+func (s *IntSet) Backward() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i := len(s.words) - 1; i >= 0; i-- {
+			word := s.words[i]
+			for word != 0 {
+				j := intLen - 1 - bits.LeadingZeros(word)
+				if !yield(i*intLen + j) {
+					return
+				}
+				word &^= 1 << j
+			}
+		}
+	}
+}
+
+// Number of words, ignoring trailing zero words.
+func (s *IntSet) nonZeroLen() int {
+	n := len(s.words)
+	for n > 0 && s.words[n-1] == 0 {
+		n--
+	}
+	return n
+}
+
+// Compact trims trailing zero words; if this leaves most of
+// the underlying array unused, the words are reallocated, so
+// that the array can be garbage collected.
+func (s *IntSet) Compact() {
+	n := s.nonZeroLen()
+	if cap(s.words) > 2*n {
+		t := make([]uint, n)
+		copy(t, s.words)
+		s.words = t
+		s.shared.Store(false)
+	} else {
+		s.words = s.words[:n]
+	}
+}
+
+// Binary encoding:
+//
+//	- one version byte (binVersion);
+//	- the number of 64-bit words, as an uvarint;
+//	- the words themselves, little-endian, 8 bytes each.
+//
+// Words are always 64-bit on the wire, whatever intLen is, so that
+// a set encoded on a 32-bit machine can be decoded on a 64-bit one,
+// and conversely. Trailing zero words aren't encoded.
+const (
+	binVersion = 1
+
+	// number of uint per 64-bit word
+	perWord64 = 64 / intLen
+)
+
+var (
+	errBinVersion  = errors.New("intset: unsupported binary encoding version")
+	errBinTrailing = errors.New("intset: trailing data after binary encoding")
+	errTextFormat  = errors.New("intset: text encoding should be of the form {1 2 3}")
+)
+
+// Number of 64-bit words needed to hold s, ignoring
+// trailing zero words.
+func (s *IntSet) len64() int {
+	n := s.nonZeroLen()
+	return (n + perWord64 - 1) / perWord64
+}
+
+// i-th 64-bit word of s
+func (s *IntSet) word64(i int) uint64 {
+	var w uint64
+	for k := 0; k < perWord64; k++ {
+		if j := i*perWord64 + k; j < len(s.words) {
+			w |= uint64(s.words[j]) << (k * intLen)
+		}
+	}
+	return w
+}
+
+// Sets the i-th 64-bit word of s; s.words must already be
+// large enough.
+func (s *IntSet) setWord64(i int, w uint64) {
+	for k := 0; k < perWord64; k++ {
+		s.words[i*perWord64+k] = uint(w >> (k * intLen))
+	}
+}
+
+// WriteTo implements io.WriterTo; this is the binary encoding, but
+// streamed, so as to avoid holding a second copy of a large set in
+// memory.
+func (s *IntSet) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	n := s.len64()
+
+	var hdr [1 + binary.MaxVarintLen64]byte
+	hdr[0] = binVersion
+	m := 1 + binary.PutUvarint(hdr[1:], uint64(n))
+
+	// bufio.Writer only reports what reached w on Flush(), so
+	// we count on our side, and adjust on error.
+	bw.Write(hdr[:m])
+
+	var buf [8]byte
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(buf[:], s.word64(i))
+		bw.Write(buf[:])
+	}
+
+	total := int64(m) + 8*int64(n)
+	if err := bw.Flush(); err != nil {
+		return total - int64(bw.Buffered()), err
+	}
+	return total, nil
+}
+
+// Counts bytes read, and provides io.ByteReader for
+// binary.ReadUvarint()
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.(io.ByteReader).ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// ReadFrom implements io.ReaderFrom, reading a set encoded by
+// WriteTo (or MarshalBinary); the previous content of s is lost.
+//
+// NOTE: the encoding being self-delimited, we stop reading right
+// after the last word, and not necessarily on io.EOF. If r isn't
+// an io.ByteReader, it is buffered, and we may then have consumed
+// more than that from r.
+func (s *IntSet) ReadFrom(r io.Reader) (int64, error) {
+	if _, ok := r.(io.ByteReader); !ok {
+		r = bufio.NewReader(r)
+	}
+	cr := &countingReader{r, 0}
+
+	v, err := cr.ReadByte()
+	if err != nil {
+		return cr.n, err
+	}
+	if v != binVersion {
+		return cr.n, errBinVersion
+	}
+
+	n, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return cr.n, err
+	}
+
+	// Don't trust n for allocations: grow as we actually read words.
+	// s is left untouched until the last one has been read.
+	t := &IntSet{words: make([]uint, 0)}
+	var buf [8]byte
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(cr, buf[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return cr.n, err
+		}
+		for k := 0; k < perWord64; k++ {
+			t.words = append(t.words, 0)
+		}
+		t.setWord64(int(i), binary.LittleEndian.Uint64(buf[:]))
+	}
+
+	s.words = t.words
+	s.shared.Store(false)
+	return cr.n, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (s *IntSet) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (s *IntSet) UnmarshalBinary(data []byte) error {
+	n, err := s.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if n != int64(len(data)) {
+		return errBinTrailing
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler, using
+// the same format as String()
+func (s *IntSet) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// If not 0, elements accepted by UnmarshalText and UnmarshalJSON
+// must be below MaxDecoded: a set takes a bit per integer up to
+// its largest element, so e.g. "{1000000000000}" allocates ~125GB.
+// Set it when decoding untrusted input; anything MarshalText or
+// MarshalJSON produce always decodes otherwise.
+var MaxDecoded int
+
+func checkDecoded(n int) error {
+	if n < 0 {
+		return fmt.Errorf("intset: negative element %d", n)
+	}
+	if MaxDecoded > 0 && n >= MaxDecoded {
+		return fmt.Errorf("intset: element %d too large (MaxDecoded: %d)", n, MaxDecoded)
+	}
+	return nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler; elements
+// don't need to be sorted, nor unique (see also MaxDecoded).
+func (s *IntSet) UnmarshalText(text []byte) error {
+	str := strings.TrimSpace(string(text))
+	if len(str) < 2 || str[0] != '{' || str[len(str)-1] != '}' {
+		return errTextFormat
+	}
+
+	t := &IntSet{words: make([]uint, 0)}
+	for _, f := range strings.Fields(str[1 : len(str)-1]) {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return fmt.Errorf("intset: invalid element %q: %w", f, err)
+		}
+		if err := checkDecoded(n); err != nil {
+			return err
+		}
+		t.Add(n)
+	}
+
+	s.words = t.words
+	s.shared.Store(false)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, as a sorted
+// array of integers; this takes precedence over MarshalText,
+// which would have encoded the set as a string.
+func (s *IntSet) MarshalJSON() ([]byte, error) {
+	buf := []byte{'['}
+	for i, n := range s.Elems() {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendInt(buf, int64(n), 10)
+	}
+	return append(buf, ']'), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, for symmetry (see
+// also MaxDecoded).
+func (s *IntSet) UnmarshalJSON(data []byte) error {
+	var ns []int
+	if err := json.Unmarshal(data, &ns); err != nil {
+		return err
+	}
+
+	t := &IntSet{words: make([]uint, 0)}
+	for _, n := range ns {
+		if err := checkDecoded(n); err != nil {
+			return err
+		}
+		t.Add(n)
+	}
+
+	s.words = t.words
+	s.shared.Store(false)
+	return nil
+}
+
 func main() {
-	s := &IntSet{make([]uint, 0)}
+	s := &IntSet{words: make([]uint, 0)}
 
 	s.AddAll(5, 19, 42, 1999110232)
 
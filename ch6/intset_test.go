@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"math/rand/v2"
 	"testing"
 	"slices"
+	"sync"
 )
 
+// IntSet{make([]uint, 0)} no longer compiles, now that IntSet
+// has more than one field.
+func newIntSet() *IntSet {
+	return &IntSet{words: make([]uint, 0)}
+}
+
 func TestLen(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 
 	if s.Len() != 0 {
 		t.Errorf("Len({}) != 0")
@@ -26,7 +36,7 @@ func TestLen(t *testing.T) {
 }
 
 func TestRemove(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 
 	s.Remove(0)
 
@@ -60,7 +70,7 @@ func TestRemove(t *testing.T) {
 }
 
 func TestClear(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 
 	s.AddAll(5, 99, 1024)
 
@@ -76,7 +86,7 @@ func TestClear(t *testing.T) {
 }
 
 func TestCopy(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 
 	s.AddAll(5, 99, 1024)
 
@@ -103,7 +113,7 @@ func TestCopy(t *testing.T) {
 
 // NOTE: AddAll is indirectly tested here and there
 func TestAddAllElems(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 
 	ns := []int{1, 2, 10, 98}
 	s.AddAll(ns...)
@@ -115,7 +125,7 @@ func TestAddAllElems(t *testing.T) {
 }
 
 func TestIntersectWith(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 	s.AddAll(1, 42, 18, 67, 910)
 
 	s0 := s.String()
@@ -125,7 +135,7 @@ func TestIntersectWith(t *testing.T) {
 		t.Errorf("Intersection with self shouldn't change anything")
 	}
 
-	x := &IntSet{make([]uint, 0)}
+	x := newIntSet()
 	x.AddAll(1, 42, 11, 912)
 
 	s.IntersectWith(x)
@@ -133,10 +143,21 @@ func TestIntersectWith(t *testing.T) {
 	if !slices.Equal(s.Elems(), []int{1, 42}) {
 		t.Errorf("Intersect {1 42 18 67 910} {1 42 11 912} != {1 42}")
 	}
+
+	// t shorter than s
+	s.AddAll(1000, 2000)
+	x = newIntSet()
+	x.Add(1)
+
+	s.IntersectWith(x)
+
+	if !slices.Equal(s.Elems(), []int{1}) {
+		t.Errorf("Intersect {1 42 1000 2000} {1} != {1}, got %s", s)
+	}
 }
 
 func TestDifferenceWith(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 	s.AddAll(1, 42, 18, 67, 910)
 
 	s.DifferenceWith(s)
@@ -147,7 +168,7 @@ func TestDifferenceWith(t *testing.T) {
 
 	s.AddAll(1, 42, 18, 67, 910)
 
-	x := &IntSet{make([]uint, 0)}
+	x := newIntSet()
 	x.AddAll(1, 42, 11, 912)
 
 	s.DifferenceWith(x)
@@ -159,7 +180,7 @@ func TestDifferenceWith(t *testing.T) {
 }
 
 func TestSymmetricDifferenceWith(t *testing.T) {
-	s := &IntSet{make([]uint, 0)}
+	s := newIntSet()
 	s.AddAll(1, 42, 18, 67, 910)
 
 	s.SymmetricDifferenceWith(s)
@@ -170,7 +191,7 @@ func TestSymmetricDifferenceWith(t *testing.T) {
 
 	s.AddAll(1, 42, 18, 67, 910)
 
-	x := &IntSet{make([]uint, 0)}
+	x := newIntSet()
 	x.AddAll(1, 42, 11, 912, 1024)
 
 	s.SymmetricDifferenceWith(x)
@@ -179,3 +200,561 @@ func TestSymmetricDifferenceWith(t *testing.T) {
 		t.Errorf("{1 42 18 67 910} ^- {1 42 11 912 1024} != {11 18 67 910 912 1024}")
 	}
 }
+
+func TestMarshalBinary(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(1, 64, 65)
+
+	xs, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Words are 64-bit on the wire, whatever intLen is.
+	ys := []byte{
+		binVersion, 2,
+		0x02, 0, 0, 0, 0, 0, 0, 0,
+		0x03, 0, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(xs, ys) {
+		t.Errorf("%v != %v", xs, ys)
+	}
+
+	// trailing zero words aren't encoded
+	s.Remove(64)
+	s.Remove(65)
+	xs, _ = s.MarshalBinary()
+	if !bytes.Equal(xs, append([]byte{binVersion, 1}, ys[2:10]...)) {
+		t.Errorf("Trailing zero words should have been trimmed: %v", xs)
+	}
+
+	x := newIntSet()
+	x.AddAll(7, 42)
+	if err := x.UnmarshalBinary(ys); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(x.Elems(), []int{1, 64, 65}) {
+		t.Errorf("%v != {1 64 65}", x)
+	}
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	x := newIntSet()
+
+	if err := x.UnmarshalBinary([]byte{}); err == nil {
+		t.Errorf("Empty input should have failed")
+	}
+	if err := x.UnmarshalBinary([]byte{binVersion+1, 0}); err != errBinVersion {
+		t.Errorf("Unknown version should have failed; got %v", err)
+	}
+	if err := x.UnmarshalBinary([]byte{binVersion, 1, 0x02}); err == nil {
+		t.Errorf("Truncated word should have failed")
+	}
+	if err := x.UnmarshalBinary([]byte{binVersion, 0, 0}); err != errBinTrailing {
+		t.Errorf("Trailing data should have failed; got %v", err)
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(0, 3, 1000, 1<<20)
+	x := newIntSet()
+	x.AddAll(5, 99)
+
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo: n=%d, len=%d, err=%v", n, buf.Len(), err)
+	}
+	m, _ := x.WriteTo(&buf)
+	if n+m != int64(buf.Len()) {
+		t.Fatalf("WriteTo: %d+%d != %d", n, m, buf.Len())
+	}
+
+	// Two sets in a row: we shouldn't read past the first one.
+	y, z := &IntSet{}, &IntSet{}
+	if k, err := y.ReadFrom(&buf); err != nil || k != n {
+		t.Fatalf("ReadFrom: k=%d (!= %d), err=%v", k, n, err)
+	}
+	if _, err := z.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	if y.String() != s.String() || z.String() != x.String() {
+		t.Errorf("%s != %s or %s != %s", y, s, z, x)
+	}
+}
+
+// A truncated stream leaves the set untouched.
+func TestReadFromTruncated(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(1, 1000, 5000)
+	bs, _ := s.MarshalBinary()
+
+	x := newIntSet()
+	x.AddAll(5, 99)
+	for n := 0; n < len(bs); n++ {
+		if _, err := x.ReadFrom(bytes.NewReader(bs[:n])); err == nil {
+			t.Fatalf("%d bytes: truncated stream should have failed", n)
+		}
+		if x.String() != "{5 99}" {
+			t.Fatalf("%d bytes: set modified: %s", n, x)
+		}
+	}
+}
+
+// With MaxDecoded, "{1000000000000}" fails instead of allocating
+// ~125GB.
+func TestUnmarshalHuge(t *testing.T) {
+	defer func(old int) { MaxDecoded = old }(MaxDecoded)
+	MaxDecoded = 1 << 16
+
+	x := newIntSet()
+	x.AddAll(5, 99)
+
+	if err := x.UnmarshalText([]byte("{1000000000000}")); err == nil {
+		t.Errorf("Huge text element should have failed")
+	}
+	if err := x.UnmarshalJSON([]byte("[1000000000000]")); err == nil {
+		t.Errorf("Huge JSON element should have failed")
+	}
+	if x.String() != "{5 99}" {
+		t.Errorf("Set modified: %s", x)
+	}
+
+	// still fine for sparse, but reasonable, sets
+	if err := x.UnmarshalText([]byte("{1 65535}")); err != nil || x.String() != "{1 65535}" {
+		t.Errorf("Unexpected error: %v (%s)", err, x)
+	}
+}
+
+// Without MaxDecoded, whatever is marshaled can be unmarshaled,
+// large elements included.
+func TestMarshalRoundTrip(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(5, 19, 42, 100000, 1999110232)
+
+	xs, err := s.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := newIntSet()
+	if err := x.UnmarshalText(xs); err != nil || x.String() != s.String() {
+		t.Errorf("Text: %s != %s (%v)", x, s, err)
+	}
+
+	xs, err = json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x = newIntSet()
+	if err := json.Unmarshal(xs, x); err != nil || x.String() != s.String() {
+		t.Errorf("JSON: %s != %s (%v)", x, s, err)
+	}
+
+	x = newIntSet()
+	if err := x.UnmarshalJSON([]byte("[100000]")); err != nil || x.String() != "{100000}" {
+		t.Errorf("Unexpected JSON: %s (%v)", x, err)
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(1, 42, 18, 67, 910)
+
+	xs, err := s.MarshalText()
+	if err != nil || string(xs) != s.String() {
+		t.Errorf("%s != %s (%v)", xs, s, err)
+	}
+
+	x := newIntSet()
+	if err := x.UnmarshalText(xs); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if x.String() != s.String() {
+		t.Errorf("%s != %s", x, s)
+	}
+
+	if err := x.UnmarshalText([]byte(" {} ")); err != nil || x.Len() != 0 {
+		t.Errorf("{} should be parsed as the empty set (%s, %v)", x, err)
+	}
+
+	for _, str := range []string{"", "{", "1 2}", "{1 a}", "{-1}", "{1,2}"} {
+		if err := x.UnmarshalText([]byte(str)); err == nil {
+			t.Errorf("'%s' should have failed", str)
+		}
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(910, 1, 42)
+
+	xs, err := json.Marshal(s)
+	if err != nil || string(xs) != "[1,42,910]" {
+		t.Errorf("%s != [1,42,910] (%v)", xs, err)
+	}
+
+	xs, _ = json.Marshal(&IntSet{})
+	if string(xs) != "[]" {
+		t.Errorf("%s != []", xs)
+	}
+
+	x := newIntSet()
+	if err := json.Unmarshal([]byte("[42, 1, 910]"), x); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if x.String() != s.String() {
+		t.Errorf("%s != %s", x, s)
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	s := newIntSet()
+	s.SetCopyOnWrite(true)
+	s.AddAll(5, 99, 1024)
+
+	x := s.Copy()
+
+	if &x.words[0] != &s.words[0] {
+		t.Errorf("Copy() should have shared the words")
+	}
+
+	s.Remove(99)
+	s.Add(2048)
+
+	if !x.Has(99) || x.Has(2048) || x.Len() != 3 {
+		t.Errorf("Writes to the original shouldn't have altered the copy: %s", x)
+	}
+
+	x.Add(7)
+	if s.Has(7) || !slices.Equal(s.Elems(), []int{5, 1024, 2048}) {
+		t.Errorf("Writes to the copy shouldn't have altered the original: %s", s)
+	}
+
+	// Copy of a copy
+	y := x.Copy()
+	x.Clear()
+	if y.String() != "{5 7 99 1024}" {
+		t.Errorf("Clear() shouldn't have altered the copy: %s", y)
+	}
+}
+
+// To be run with -race: the copy can be read while the original is
+// being written to.
+func TestCopyOnWriteRace(t *testing.T) {
+	s := newIntSet()
+	s.SetCopyOnWrite(true)
+	s.AddAll(1, 2, 3)
+
+	x := s.Copy()
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if !x.Has(2) || x.Len() != 3 {
+				t.Errorf("Copy altered: %s", x)
+				break
+			}
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 1000; i++ {
+		s.Add(i)
+		s.Remove(2)
+	}
+	<-done
+}
+
+// Read-only sets, e.g. shared between request handlers, can be
+// copied concurrently (go test -race).
+func TestCopyOnWriteConcurrentCopy(t *testing.T) {
+	s := newIntSet()
+	s.SetCopyOnWrite(true)
+	s.AddAll(1, 2, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				x := s.Copy()
+				x.Add(j)
+				if !s.Has(1) || s.Has(j+4) {
+					t.Errorf("Original altered: %s", s)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAddRange(t *testing.T) {
+	for _, r := range [][2]int{{0, 0}, {3, 3}, {0, 1}, {5, 10}, {0, 64}, {1, 200}, {63, 65}, {-5, 3}} {
+		s := newIntSet()
+		x := newIntSet()
+
+		s.AddRange(r[0], r[1])
+		for i := max(r[0], 0); i < r[1]; i++ {
+			x.Add(i)
+		}
+
+		if s.String() != x.String() {
+			t.Errorf("AddRange(%d, %d): %s != %s", r[0], r[1], s, x)
+		}
+	}
+}
+
+func TestRemoveRange(t *testing.T) {
+	s := newIntSet()
+	s.AddRange(0, 200)
+
+	s.RemoveRange(10, 150)
+	s.RemoveRange(190, 1000)
+	s.RemoveRange(5, 5)
+
+	x := newIntSet()
+	x.AddRange(0, 10)
+	x.AddRange(150, 190)
+
+	if s.String() != x.String() {
+		t.Errorf("%s != %s", s, x)
+	}
+
+	s.RemoveRange(-1, 1<<20)
+	if s.Len() != 0 {
+		t.Errorf("%s != {}", s)
+	}
+}
+
+func TestComplementFlip(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(1, 3, 70)
+
+	s.Complement(0, 5)
+	if !slices.Equal(s.Elems(), []int{0, 2, 4, 70}) {
+		t.Errorf("%s != {0 2 4 70}", s)
+	}
+
+	s.Complement(60, 130)
+	s.Complement(60, 130)
+	if !slices.Equal(s.Elems(), []int{0, 2, 4, 70}) {
+		t.Errorf("Complement() twice should be a no-op: %s", s)
+	}
+
+	s.Flip(2)
+	s.Flip(1000)
+	if !slices.Equal(s.Elems(), []int{0, 4, 70, 1000}) {
+		t.Errorf("%s != {0 4 70 1000}", s)
+	}
+}
+
+func TestAllBackward(t *testing.T) {
+	s := newIntSet()
+	ns := []int{0, 1, 63, 64, 65, 127, 1024}
+	s.AddAll(ns...)
+
+	if xs := slices.Collect(s.All()); !slices.Equal(xs, ns) {
+		t.Errorf("%v != %v", xs, ns)
+	}
+
+	ms := slices.Clone(ns)
+	slices.Reverse(ms)
+	if xs := slices.Collect(s.Backward()); !slices.Equal(xs, ms) {
+		t.Errorf("%v != %v", xs, ms)
+	}
+
+	// early break
+	var xs []int
+	for n := range s.All() {
+		if n > 64 {
+			break
+		}
+		xs = append(xs, n)
+	}
+	if !slices.Equal(xs, ns[:4]) {
+		t.Errorf("%v != %v", xs, ns[:4])
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(1, 1<<16)
+	s.Remove(1 << 16)
+
+	s.Compact()
+	if len(s.words) != 1 || cap(s.words) != 1 {
+		t.Errorf("Compact(): len=%d, cap=%d", len(s.words), cap(s.words))
+	}
+	if s.String() != "{1}" {
+		t.Errorf("%s != {1}", s)
+	}
+
+	s.RemoveRange(0, 10)
+	s.Compact()
+	if len(s.words) != 0 || s.String() != "{}" {
+		t.Errorf("%s != {}", s)
+	}
+}
+
+// map-based reference implementation, for property testing
+type refSet map[int]bool
+
+func randomSets(r *rand.Rand, n int) ([]*IntSet, []refSet) {
+	ss := make([]*IntSet, n)
+	rs := make([]refSet, n)
+	for i := range ss {
+		ss[i] = newIntSet()
+		rs[i] = make(refSet)
+
+		// vary both density and size
+		m := r.IntN(500) + 1
+		for k := r.IntN(100); k > 0; k-- {
+			x := r.IntN(m)
+			ss[i].Add(x)
+			rs[i][x] = true
+		}
+	}
+	return ss, rs
+}
+
+func refElems(r refSet) []int {
+	ns := make([]int, 0, len(r))
+	for x := range r {
+		ns = append(ns, x)
+	}
+	slices.Sort(ns)
+	return ns
+}
+
+// counts in how many sets each element is
+func refCounts(rs []refSet) map[int]int {
+	cs := make(map[int]int)
+	for _, r := range rs {
+		for x := range r {
+			cs[x]++
+		}
+	}
+	return cs
+}
+
+func TestSetAlgebraProperties(t *testing.T) {
+	r := rand.New(rand.NewPCG(42, 1999))
+
+	for k := 0; k < 500; k++ {
+		ss, rs := randomSets(r, r.IntN(4)+1)
+		s0 := ss[0].String()
+		cs := refCounts(rs)
+
+		union, inter, diff, sym := make(refSet), make(refSet), make(refSet), make(refSet)
+		for x, c := range cs {
+			union[x] = true
+			if c == len(rs) {
+				inter[x] = true
+			}
+			if c%2 == 1 {
+				sym[x] = true
+			}
+			if rs[0][x] && c == 1 {
+				diff[x] = true
+			}
+		}
+
+		for _, tc := range []struct {
+			name string
+			s    *IntSet
+			r    refSet
+		}{
+			{"Union", Union(ss...), union},
+			{"Intersection", Intersection(ss...), inter},
+			{"Difference", Difference(ss[0], ss[1:]...), diff},
+			{"SymmetricDifference", SymmetricDifference(ss...), sym},
+		} {
+			if xs, ys := tc.s.Elems(), refElems(tc.r); !slices.Equal(xs, ys) {
+				t.Fatalf("%s(%v): %v != %v", tc.name, ss, xs, ys)
+			}
+		}
+
+		if ss[0].String() != s0 {
+			t.Fatalf("Operands shouldn't have been modified: %s != %s", ss[0], s0)
+		}
+
+		if len(ss) < 2 {
+			continue
+		}
+		s, x := ss[0], ss[1]
+		rs0, rs1 := rs[0], rs[1]
+
+		equal, subset, disjoint, n := len(rs0) == len(rs1), true, true, 0
+		for y := range rs0 {
+			if rs1[y] {
+				disjoint = false
+				n++
+			} else {
+				equal, subset = false, false
+			}
+		}
+
+		if s.Equal(x) != equal {
+			t.Fatalf("%s.Equal(%s) != %v", s, x, equal)
+		}
+		if s.SubsetOf(x) != subset {
+			t.Fatalf("%s.SubsetOf(%s) != %v", s, x, subset)
+		}
+		if s.Disjoint(x) != disjoint {
+			t.Fatalf("%s.Disjoint(%s) != %v", s, x, disjoint)
+		}
+		if s.IntersectionLen(x) != n {
+			t.Fatalf("%s.IntersectionLen(%s) != %d", s, x, n)
+		}
+
+		// and the mutating versions agree with the pure ones
+		y := s.Copy()
+		y.IntersectWith(x)
+		if !y.Equal(Intersection(s, x)) {
+			t.Fatalf("IntersectWith(): %s != %s", y, Intersection(s, x))
+		}
+		y = s.Copy()
+		y.SymmetricDifferenceWith(x)
+		if !y.Equal(SymmetricDifference(s, x)) {
+			t.Fatalf("SymmetricDifferenceWith(): %s != %s", y, SymmetricDifference(s, x))
+		}
+	}
+}
+
+func TestEqualTrailingWords(t *testing.T) {
+	s := newIntSet()
+	s.AddAll(1, 2)
+	x := s.Copy()
+	x.Add(1000)
+	x.Remove(1000)
+
+	if !s.Equal(x) || !x.Equal(s) {
+		t.Errorf("Trailing zero words shouldn't matter")
+	}
+	if !s.SubsetOf(x) || !x.SubsetOf(s) {
+		t.Errorf("Equal sets should be subsets of each other")
+	}
+	if !(&IntSet{}).SubsetOf(s) || !(&IntSet{}).Disjoint(s) {
+		t.Errorf("{} is a subset of, and is disjoint from any set")
+	}
+}
+
+func TestRelationsNoAlloc(t *testing.T) {
+	s := newIntSet()
+	s.AddRange(0, 1000)
+	x := newIntSet()
+	x.AddRange(500, 2000)
+
+	n := testing.AllocsPerRun(100, func() {
+		s.Equal(x)
+		s.SubsetOf(x)
+		s.Disjoint(x)
+		s.IntersectionLen(x)
+	})
+	if n != 0 {
+		t.Errorf("%f allocations", n)
+	}
+}
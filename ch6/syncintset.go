@@ -0,0 +1,154 @@
+package main
+
+import (
+	"iter"
+	"sync"
+	"sync/atomic"
+)
+
+// An IntSet which can be shared between goroutines. The zero
+// value is an empty set, ready to use.
+//
+// Writes are serialized by mu. Reads go through a read-only
+// snapshot of the set when one is available, without locking;
+// otherwise, they fall back to mu.RLock().
+//
+// The snapshot is a copy-on-write Copy() of set, so publishing it
+// is O(1), but the first write that follows will have to clone the
+// words. This favors read-mostly sets (e.g. membership sets shared
+// between request handlers); for write-heavy sets, snapshots will
+// be frequently cloned.
+type SyncIntSet struct {
+	mu  sync.RWMutex // guards set
+	set IntSet
+
+	// read-only snapshot of set, nil when stale
+	snap atomic.Pointer[IntSet]
+}
+
+// Runs f on a read-only version of the set.
+func (s *SyncIntSet) read(f func(*IntSet)) {
+	if t := s.snap.Load(); t != nil {
+		f(t)
+		return
+	}
+
+	s.mu.RLock()
+	f(&s.set)
+	s.mu.RUnlock()
+
+	s.publish()
+}
+
+// Publishes a new snapshot, unless someone else is already
+// holding the lock, in which case we'll try again later.
+func (s *SyncIntSet) publish() {
+	if !s.mu.TryLock() {
+		return
+	}
+	if s.snap.Load() == nil {
+		s.set.SetCopyOnWrite(true)
+		s.snap.Store(s.set.Copy())
+	}
+	s.mu.Unlock()
+}
+
+// Runs f on the set, with exclusive access.
+func (s *SyncIntSet) write(f func(*IntSet)) {
+	s.mu.Lock()
+	f(&s.set)
+	s.snap.Store(nil)
+	s.mu.Unlock()
+}
+
+func (s *SyncIntSet) Has(x int) (b bool) {
+	s.read(func(t *IntSet) { b = t.Has(x) })
+	return b
+}
+
+func (s *SyncIntSet) Len() (n int) {
+	s.read(func(t *IntSet) { n = t.Len() })
+	return n
+}
+
+func (s *SyncIntSet) Elems() (ns []int) {
+	s.read(func(t *IntSet) { ns = t.Elems() })
+	return ns
+}
+
+func (s *SyncIntSet) String() (str string) {
+	s.read(func(t *IntSet) { str = t.String() })
+	return str
+}
+
+// Snapshot returns a copy of s, in O(1): the copy is not shared
+// with other goroutines, and can be freely modified.
+func (s *SyncIntSet) Snapshot() *IntSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set.SetCopyOnWrite(true)
+	return s.set.Copy()
+}
+
+// All iterates on a snapshot of s, so s can be modified
+// while iterating.
+func (s *SyncIntSet) All() iter.Seq[int] {
+	return s.Snapshot().All()
+}
+
+func (s *SyncIntSet) Backward() iter.Seq[int] {
+	return s.Snapshot().Backward()
+}
+
+func (s *SyncIntSet) Add(x int) {
+	s.write(func(t *IntSet) { t.Add(x) })
+}
+
+func (s *SyncIntSet) AddAll(ns ...int) {
+	s.write(func(t *IntSet) { t.AddAll(ns...) })
+}
+
+func (s *SyncIntSet) Remove(x int) {
+	s.write(func(t *IntSet) { t.Remove(x) })
+}
+
+func (s *SyncIntSet) AddRange(lo, hi int) {
+	s.write(func(t *IntSet) { t.AddRange(lo, hi) })
+}
+
+func (s *SyncIntSet) RemoveRange(lo, hi int) {
+	s.write(func(t *IntSet) { t.RemoveRange(lo, hi) })
+}
+
+func (s *SyncIntSet) Complement(lo, hi int) {
+	s.write(func(t *IntSet) { t.Complement(lo, hi) })
+}
+
+func (s *SyncIntSet) Flip(x int) {
+	s.write(func(t *IntSet) { t.Flip(x) })
+}
+
+func (s *SyncIntSet) Clear() {
+	s.write(func(t *IntSet) { t.Clear() })
+}
+
+func (s *SyncIntSet) Compact() {
+	s.write(func(t *IntSet) { t.Compact() })
+}
+
+// NOTE: t must not be concurrently modified.
+func (s *SyncIntSet) UnionWith(t *IntSet) {
+	s.write(func(u *IntSet) { u.UnionWith(t) })
+}
+
+func (s *SyncIntSet) IntersectWith(t *IntSet) {
+	s.write(func(u *IntSet) { u.IntersectWith(t) })
+}
+
+func (s *SyncIntSet) DifferenceWith(t *IntSet) {
+	s.write(func(u *IntSet) { u.DifferenceWith(t) })
+}
+
+func (s *SyncIntSet) SymmetricDifferenceWith(t *IntSet) {
+	s.write(func(u *IntSet) { u.SymmetricDifferenceWith(t) })
+}
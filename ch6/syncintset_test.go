@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Those are mostly meant to be run with -race.
+
+func TestSyncIntSet(t *testing.T) {
+	var s SyncIntSet
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+
+		// writer
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Add(i*100 + j)
+			}
+		}(i)
+
+		// reader
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Has(j)
+				s.Len()
+				_ = s.String()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.Len() != 800 {
+		t.Errorf("Len() = %d ≠ 800", s.Len())
+	}
+
+	s.Remove(42)
+	if s.Has(42) || s.Len() != 799 {
+		t.Errorf("42 should have been removed")
+	}
+}
+
+// Reads served by the snapshot should see writes performed
+// before them.
+func TestSyncIntSetStaleSnapshot(t *testing.T) {
+	var s SyncIntSet
+
+	s.AddAll(1, 2, 3)
+
+	// publish a snapshot
+	if !s.Has(2) || s.snap.Load() == nil {
+		t.Fatalf("A snapshot should have been published")
+	}
+
+	s.Remove(2)
+	if s.Has(2) {
+		t.Errorf("2 should have been removed")
+	}
+
+	x := newIntSet()
+	x.AddAll(3, 4)
+	s.IntersectWith(x)
+	if !slices.Equal(s.Elems(), []int{3}) {
+		t.Errorf("%s != {3}", s.String())
+	}
+}
+
+func TestSyncIntSetSnapshot(t *testing.T) {
+	var s SyncIntSet
+	var wg sync.WaitGroup
+
+	s.AddAll(1, 2, 3)
+	x := s.Snapshot()
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			s.Add(i)
+			s.Remove(2)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if x.String() != "{1 2 3}" {
+				t.Errorf("Snapshot altered: %s", x)
+				break
+			}
+		}
+	}()
+	wg.Wait()
+
+	// snapshots are ours to modify
+	x.Add(1999)
+	if s.Has(1999) {
+		t.Errorf("Writing to the snapshot shouldn't alter s")
+	}
+}
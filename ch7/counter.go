@@ -0,0 +1,244 @@
+package main
+
+// Counting writers: a generic SplitCounter turning any
+// bufio.SplitFunc into a counting io.Writer, and combinators:
+//
+//	lines := NewSplitCounter(SplitFunc(bufio.ScanLines))
+//	words := &WordCounter{}
+//	m := MultiCounter{lines, Live(words)}
+//	stop := Progress(m[1], time.Second, func(n int64) { ... })
+//	io.Copy(m, r)
+//	m.Close()
+//	stop()
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A counting io.Writer; unless stated otherwise, Count() must
+// not be called concurrently with Write() (see Live).
+type Counter interface {
+	io.Writer
+	Count() int64
+}
+
+// Counters with a last item to count once the input is over,
+// e.g. a last word not followed by a space.
+type Flusher interface {
+	Flush()
+}
+
+// A Splitter provides a bufio.SplitFunc. S is usually a zero-size
+// type (e.g. graphemes), so SplitCounter[S] is ready to use as is.
+type Splitter interface {
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+}
+
+// Any bufio.SplitFunc, as a Splitter.
+type SplitFunc bufio.SplitFunc
+
+func (f SplitFunc) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return f(data, atEOF)
+}
+
+// SplitCounter counts the tokens returned by S; a token may be
+// split between two calls to Write. Count() can be called from
+// other goroutines while writes continue.
+//
+// The split function may need to look ahead, so what isn't
+// consumed yet is saved until the next Write, and scanned again
+// from its start; it's only counted by Flush(), once the input is
+// over. As with bufio.Scanner, tokens are limited to
+// bufio.MaxScanTokenSize bytes: Write fails with bufio.ErrTooLong
+// past that.
+type SplitCounter[S Splitter] struct {
+	n atomic.Int64
+	p []byte // what remained last time
+	s S
+
+	// called on each token, which may be overwritten
+	// once token returns (see FrequencyCounter)
+	token func(p []byte)
+}
+
+func NewSplitCounter[S Splitter](s S) *SplitCounter[S] {
+	return &SplitCounter[S]{s: s}
+}
+
+func (c *SplitCounter[S]) Count() int64 {
+	return c.n.Load()
+}
+
+// Consumes q, as far as possible; returns what's been consumed.
+func (c *SplitCounter[S]) scan(q []byte, atEOF bool) (int, error) {
+	m := 0
+	for m < len(q) {
+		n, ts, err := c.s.Split(q[m:], atEOF)
+		if err != nil {
+			return m, err
+		}
+		if n == 0 {
+			break
+		}
+		m += n
+
+		// we may be advancing further, but still not reaching
+		// a word (spaces); an empty line is still a line though.
+		if ts != nil {
+			c.n.Add(1)
+			if c.token != nil {
+				c.token(ts)
+			}
+		}
+	}
+	return m, nil
+}
+
+// NOTE: what isn't consumed is saved for later, so as far as the
+// caller is concerned, all of p has been written (this is what
+// io.Writer expects, and e.g. io.MultiWriter checks).
+func (c *SplitCounter[S]) Write(p []byte) (int, error) {
+	// Grab what remained last time.
+	q := p
+	if len(c.p) > 0 {
+		q = append(c.p, p...)
+	}
+
+	m, err := c.scan(q, false)
+	if err != nil {
+		return 0, err
+	}
+	if len(q)-m > bufio.MaxScanTokenSize {
+		c.p = nil
+		return 0, bufio.ErrTooLong
+	}
+
+	// p belongs to the caller: copy (in place, when q is
+	// our own buffer).
+	c.p = append(c.p[:0], q[m:]...)
+	return len(p), nil
+}
+
+// Flush counts what remains once there's nothing more to write.
+func (c *SplitCounter[S]) Flush() {
+	m, _ := c.scan(c.p, true)
+	c.p = c.p[m:]
+}
+
+func (c *SplitCounter[S]) Close() error {
+	c.Flush()
+	return nil
+}
+
+// MultiCounter fans a stream out to several counters at once.
+// Unlike io.MultiWriter's, writes go to all the counters, even
+// if one of them fails; the first error is returned.
+type MultiCounter []Counter
+
+func (m MultiCounter) Write(p []byte) (int, error) {
+	var err error
+	for _, c := range m {
+		if _, e := c.Write(p); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m MultiCounter) Counts() []int64 {
+	ns := make([]int64, len(m))
+	for i, c := range m {
+		ns[i] = c.Count()
+	}
+	return ns
+}
+
+func (m MultiCounter) Flush() {
+	for _, c := range m {
+		if f, ok := c.(Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func (m MultiCounter) Close() error {
+	m.Flush()
+	return nil
+}
+
+// LiveCounter wraps a Counter so that its count can be read from
+// other goroutines while writes continue: the count is published
+// after each Write (and Flush), so it lags behind by at most one
+// Write.
+type LiveCounter struct {
+	mu sync.Mutex // serializes writes
+	c  Counter
+	n  atomic.Int64
+}
+
+func Live(c Counter) *LiveCounter {
+	return &LiveCounter{c: c}
+}
+
+func (l *LiveCounter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.c.Write(p)
+	l.n.Store(l.c.Count())
+	return n, err
+}
+
+func (l *LiveCounter) Count() int64 {
+	return l.n.Load()
+}
+
+func (l *LiveCounter) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.c.(Flusher); ok {
+		f.Flush()
+	}
+	l.n.Store(l.c.Count())
+}
+
+func (l *LiveCounter) Close() error {
+	l.Flush()
+	return nil
+}
+
+// Progress calls f with c's count every d, from another goroutine,
+// until stop is called; f is then called a last time, before stop
+// returns. c's Count() must be safe for concurrent use (e.g.
+// SplitCounter, LiveCounter, ByteCounterWrapper).
+func Progress(c Counter, d time.Duration, f func(n int64)) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		tick := time.NewTicker(d)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				f(c.Count())
+			case <-done:
+				f(c.Count())
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+}
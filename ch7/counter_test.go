@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitCounter(t *testing.T) {
+	s := "one line\n\ntwo words\nlast"
+
+	for _, x := range []struct {
+		f   bufio.SplitFunc
+		exp int64
+	}{
+		{bufio.ScanLines, 4},
+		{bufio.ScanWords, 5},
+		{bufio.ScanRunes, int64(len(s))},
+	} {
+		c := NewSplitCounter(SplitFunc(x.f))
+		writeBytes(c, s)
+		c.Flush()
+		if c.Count() != x.exp {
+			t.Errorf("Expected %d, got %d", x.exp, c.Count())
+		}
+	}
+}
+
+// A token can span many writes, up to bufio.MaxScanTokenSize: the
+// leftover isn't left to grow without bound.
+func TestSplitCounterLongToken(t *testing.T) {
+	chunk := strings.Repeat("x", 1024)
+
+	c := NewSplitCounter(SplitFunc(bufio.ScanLines))
+	for range bufio.MaxScanTokenSize/len(chunk) - 1 {
+		if _, err := io.WriteString(c, chunk); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	io.WriteString(c, "\nshort")
+	c.Flush()
+	if c.Count() != 2 {
+		t.Errorf("Expected 2, got %d", c.Count())
+	}
+
+	c = NewSplitCounter(SplitFunc(bufio.ScanLines))
+	var err error
+	for i := 0; i < 1024 && err == nil; i++ {
+		_, err = io.WriteString(c, chunk)
+	}
+	if err != bufio.ErrTooLong {
+		t.Errorf("Expected bufio.ErrTooLong, got %v", err)
+	}
+}
+
+// Counts can be read while writes continue (go test -race).
+func TestSplitCounterConcurrent(t *testing.T) {
+	c := NewSplitCounter(SplitFunc(bufio.ScanLines))
+	l := Live(&LineCounter{})
+	m := MultiCounter{c, l}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			io.WriteString(m, "a line\n")
+		}
+	}()
+
+	prev := int64(0)
+	for prev < 1000 {
+		n := c.Count()
+		if n < prev {
+			t.Fatalf("Count went backward: %d < %d", n, prev)
+		}
+		prev = n
+		l.Count()
+	}
+	wg.Wait()
+
+	if ns := m.Counts(); ns[0] != 1000 || ns[1] != 1000 {
+		t.Errorf("Unexpected counts: %v", ns)
+	}
+}
+
+type failingCounter struct{ LineCounter }
+
+func (c *failingCounter) Write(p []byte) (int, error) {
+	return 0, errors.New("failed")
+}
+
+func TestMultiCounter(t *testing.T) {
+	w := &WordCounter{}
+	u := &UnicodeWordCounter{}
+	m := MultiCounter{w, &failingCounter{}, u}
+
+	// unlike io.MultiWriter, keeps writing
+	if _, err := io.WriteString(m, "hello, 世界"); err == nil {
+		t.Errorf("Expected an error")
+	}
+	m.Close()
+
+	if ns := m.Counts(); ns[0] != 2 || ns[1] != 0 || ns[2] != 3 {
+		t.Errorf("Unexpected counts: %v", ns)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	cw, n := CountingWriter(io.Discard)
+
+	var mu sync.Mutex
+	var seen []int64
+	stop := Progress(cw.(Counter), time.Millisecond, func(n int64) {
+		mu.Lock()
+		seen = append(seen, n)
+		mu.Unlock()
+	})
+
+	r := strings.NewReader(strings.Repeat("x", 1<<20))
+	for {
+		// small chunks, to give the ticker a chance
+		if _, err := io.CopyN(cw, r, 1024); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+	stop()
+	stop() // idempotent
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) == 0 || seen[len(seen)-1] != *n || *n != 1<<20 {
+		t.Errorf("Unexpected final progress: %v, %d", seen, *n)
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i] < seen[i-1] {
+			t.Errorf("Progress went backward: %v", seen)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+// Word (or n-gram) frequencies, e.g. to find the most common
+// words of a large corpus, in bounded memory:
+//
+//	fc := NewFrequencyCounter(FrequencyOptions{N: 2, Fold: true})
+//	io.Copy(fc, r)
+//	fc.Close()
+//	fc.WriteTSV(os.Stdout, 10)
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type FrequencyOptions struct {
+	// How to split the input into words; bufio.ScanWords
+	// by default (see also ScanUnicodeWords).
+	Split bufio.SplitFunc
+
+	// Count n-grams of N consecutive words, joined by a
+	// space; 1 (words) by default.
+	N int
+
+	// Lower-case words, so that e.g. "The" and "the" are
+	// counted together.
+	Fold bool
+
+	// Words to ignore (before n-grams are formed); case
+	// folded too if Fold is set.
+	StopWords []string
+
+	// Maximum number of distinct items monitored by the
+	// sketch, i.e. memory is O(Capacity); 1000 by default.
+	Capacity int
+}
+
+// FrequencyCounter is an io.Writer counting the frequencies
+// of the words (or n-grams) written to it.
+//
+// Words are stripped of their leading and trailing punctuation
+// (e.g. "hello," is "hello"); words made only of punctuation are
+// ignored.
+//
+// Only the most frequent items are kept, in a Space-Saving[0]
+// sketch: counts are then upper bounds, off by at most the
+// reported error, and every item occurring more than
+// n/Capacity times (n being the total) is reported.
+//
+// [0]: Metwally, Agrawal, El Abbadi, "Efficient Computation of
+// Frequent and Top-k Elements in Data Streams", 2005.
+type FrequencyCounter struct {
+	sc SplitCounter[SplitFunc]
+
+	ngram int
+	fold  bool
+	stop  map[string]bool
+
+	total int      // items counted, i.e. (n-)grams
+	last  []string // the previous ngram-1 words
+	ss    spaceSaving
+}
+
+func NewFrequencyCounter(opts FrequencyOptions) *FrequencyCounter {
+	fc := &FrequencyCounter{
+		ngram: opts.N,
+		fold:  opts.Fold,
+		stop:  make(map[string]bool),
+	}
+	fc.sc.s = SplitFunc(opts.Split)
+	if fc.sc.s == nil {
+		fc.sc.s = bufio.ScanWords
+	}
+	fc.sc.token = fc.add
+	if fc.ngram <= 0 {
+		fc.ngram = 1
+	}
+	for _, w := range opts.StopWords {
+		if fc.fold {
+			w = strings.ToLower(w)
+		}
+		fc.stop[w] = true
+	}
+	fc.ss.init(opts.Capacity)
+	return fc
+}
+
+// Counts a word.
+func (c *FrequencyCounter) add(p []byte) {
+	p = trimPunct(p)
+	if len(p) == 0 {
+		return
+	}
+
+	w := string(p)
+	if c.fold {
+		w = strings.ToLower(w)
+	}
+	if c.stop[w] {
+		return
+	}
+
+	if c.ngram == 1 {
+		c.total++
+		c.ss.add(w)
+		return
+	}
+
+	c.last = append(c.last, w)
+	if len(c.last) < c.ngram {
+		return
+	}
+	c.total++
+	c.ss.add(strings.Join(c.last, " "))
+	c.last = append(c.last[:0], c.last[1:]...)
+}
+
+func trimPunct(p []byte) []byte {
+	return bytes.TrimFunc(p, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+}
+
+func (c *FrequencyCounter) Write(p []byte) (int, error) {
+	return c.sc.Write(p)
+}
+
+// Flush counts a last word, not followed by a space.
+func (c *FrequencyCounter) Flush() {
+	c.sc.Flush()
+}
+
+func (c *FrequencyCounter) Close() error {
+	c.Flush()
+	return nil
+}
+
+// Number of words read so far, stop words included.
+func (c *FrequencyCounter) Count() int64 {
+	return c.sc.Count()
+}
+
+// Number of items (words or n-grams) counted so far.
+func (c *FrequencyCounter) Total() int {
+	return c.total
+}
+
+type Frequency struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+	// Count may be overestimated by at most Error.
+	Error int `json:"error"`
+}
+
+// Top returns the k most frequent items, by decreasing count
+// (then alphabetically); all the monitored items if k <= 0.
+func (c *FrequencyCounter) Top(k int) []Frequency {
+	fs := make([]Frequency, 0, len(c.ss.h))
+	for _, e := range c.ss.h {
+		fs = append(fs, Frequency{e.item, e.count, e.err})
+	}
+	slices.SortFunc(fs, func(a, b Frequency) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Item, b.Item)
+	})
+	if k > 0 && k < len(fs) {
+		fs = fs[:k]
+	}
+	return fs
+}
+
+// WriteTSV writes the top k items, one per line, as
+//
+//	item<TAB>count<TAB>error
+func (c *FrequencyCounter) WriteTSV(w io.Writer, k int) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range c.Top(k) {
+		// no tabs nor newlines in words, but just in case
+		item := strings.NewReplacer("\t", " ", "\n", " ").Replace(f.Item)
+		fmt.Fprintf(bw, "%s\t%d\t%d\n", item, f.Count, f.Error)
+	}
+	return bw.Flush()
+}
+
+// WriteJSON writes the top k items, as e.g.
+//
+//	{"total":3,"top":[{"item":"the","count":2,"error":0}, ...]}
+func (c *FrequencyCounter) WriteJSON(w io.Writer, k int) error {
+	return json.NewEncoder(w).Encode(struct {
+		Total int         `json:"total"`
+		Top   []Frequency `json:"top"`
+	}{c.total, c.Top(k)})
+}
+
+// Space-Saving sketch: at most cap items are monitored; a new
+// item replaces the least frequent one, inheriting its count
+// (hence the error).
+type spaceSaving struct {
+	cap   int
+	items map[string]*ssEntry
+	h     ssHeap
+}
+
+type ssEntry struct {
+	item       string
+	count, err int
+	i          int // index in the heap
+}
+
+// Min-heap, by count.
+type ssHeap []*ssEntry
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i, h[j].i = i, j
+}
+
+func (h *ssHeap) Push(x any) {
+	e := x.(*ssEntry)
+	e.i = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *ssHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func (ss *spaceSaving) init(capacity int) {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	ss.cap = capacity
+	ss.items = make(map[string]*ssEntry)
+}
+
+func (ss *spaceSaving) add(item string) {
+	if e, ok := ss.items[item]; ok {
+		e.count++
+		heap.Fix(&ss.h, e.i)
+		return
+	}
+
+	if len(ss.h) < ss.cap {
+		e := &ssEntry{item: item, count: 1}
+		ss.items[item] = e
+		heap.Push(&ss.h, e)
+		return
+	}
+
+	// evict the least frequent item
+	e := ss.h[0]
+	delete(ss.items, e.item)
+	e.item, e.err = item, e.count
+	e.count++
+	ss.items[item] = e
+	heap.Fix(&ss.h, 0)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+func TestFrequencyCounter(t *testing.T) {
+	fc := NewFrequencyCounter(FrequencyOptions{
+		Fold:      true,
+		StopWords: []string{"A"},
+	})
+
+	// words split between two writes; last word unterminated
+	fc.Write([]byte("The cat, the dog; a c"))
+	fc.Write([]byte("at -- THE end"))
+	fc.Close()
+
+	exp := []Frequency{{"the", 3, 0}, {"cat", 2, 0}}
+	if got := fc.Top(2); !reflect.DeepEqual(got, exp) {
+		t.Errorf("%v != %v", got, exp)
+	}
+	// "--" is ignored, "a" is a stop word
+	if fc.Total() != 7 {
+		t.Errorf("Expected 7 words, got %d", fc.Total())
+	}
+}
+
+func TestFrequencyCounterNGrams(t *testing.T) {
+	fc := NewFrequencyCounter(FrequencyOptions{N: 2})
+
+	fmt.Fprint(fc, "to be or not to be")
+	fc.Close()
+
+	exp := []Frequency{
+		{"to be", 2, 0}, {"be or", 1, 0}, {"not to", 1, 0}, {"or not", 1, 0},
+	}
+	if got := fc.Top(0); !reflect.DeepEqual(got, exp) {
+		t.Errorf("%v != %v", got, exp)
+	}
+}
+
+func TestFrequencyCounterUnicodeWords(t *testing.T) {
+	fc := NewFrequencyCounter(FrequencyOptions{Split: ScanUnicodeWords})
+
+	fmt.Fprint(fc, "can't stop: 世界世界")
+	fc.Close()
+
+	exp := []Frequency{{"世", 2, 0}, {"界", 2, 0}, {"can't", 1, 0}, {"stop", 1, 0}}
+	if got := fc.Top(0); !reflect.DeepEqual(got, exp) {
+		t.Errorf("%v != %v", got, exp)
+	}
+}
+
+// Heavy hitters are found, with bounded memory, and counts
+// are overestimated by at most the reported error.
+func TestFrequencyCounterSketch(t *testing.T) {
+	fc := NewFrequencyCounter(FrequencyOptions{Capacity: 20})
+	exact := make(map[string]int)
+
+	rnd := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		w := fmt.Sprintf("w%d", rnd.IntN(1000))
+		if i%4 == 0 {
+			w = "frequent"
+		} else if i%10 == 1 {
+			w = "common"
+		}
+		exact[w]++
+		b.WriteString(w + " ")
+	}
+	fc.Write(b.Bytes())
+	fc.Close()
+
+	if len(fc.ss.items) > 20 || len(fc.ss.h) > 20 {
+		t.Errorf("Too many items monitored: %d", len(fc.ss.items))
+	}
+
+	top := fc.Top(2)
+	if top[0].Item != "frequent" || top[1].Item != "common" {
+		t.Errorf("Unexpected top items: %v", top)
+	}
+	for _, f := range fc.Top(0) {
+		if n := exact[f.Item]; f.Count < n || f.Count-f.Error > n {
+			t.Errorf("%s: count %d (error %d), expected %d",
+				f.Item, f.Count, f.Error, n)
+		}
+	}
+}
+
+func TestFrequencyCounterOutput(t *testing.T) {
+	fc := NewFrequencyCounter(FrequencyOptions{})
+	fmt.Fprint(fc, "b a b ")
+
+	var b bytes.Buffer
+	fc.WriteTSV(&b, 0)
+	if b.String() != "b\t2\t0\na\t1\t0\n" {
+		t.Errorf("Unexpected TSV: %q", b.String())
+	}
+
+	b.Reset()
+	fc.WriteJSON(&b, 1)
+	var got struct {
+		Total int
+		Top   []Frequency
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", b.String(), err)
+	}
+	if got.Total != 3 || !reflect.DeepEqual(got.Top, []Frequency{{"b", 2, 0}}) {
+		t.Errorf("Unexpected JSON: %s", b.String())
+	}
+}
+
+// Same counts as with a bufio.Scanner, however the input is split.
+func TestFrequencyCounterWrites(t *testing.T) {
+	s := "one two  three\nfour\tfive six seven eight nine ten"
+	exact := make(map[string]int)
+	sc := bufio.NewScanner(bytes.NewReader([]byte(s)))
+	sc.Split(bufio.ScanWords)
+	for sc.Scan() {
+		exact[sc.Text()]++
+	}
+
+	fc := NewFrequencyCounter(FrequencyOptions{})
+	for i := range len(s) {
+		fc.Write([]byte(s[i : i+1]))
+	}
+	fc.Close()
+
+	got := make(map[string]int)
+	for _, f := range fc.Top(0) {
+		got[f.Item] = f.Count
+	}
+	if !reflect.DeepEqual(got, exact) {
+		t.Errorf("%v != %v", got, exact)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"iter"
+)
+
+// PersistentTree is an immutable version of Tree: Insert() and
+// Delete() return a new tree, which shares all the unchanged
+// subtrees with the original one (path copying: only the O(log n)
+// nodes from the root to the modified node are copied).
+//
+// Old versions are thus cheap snapshots, and can be read (e.g.
+// iterated on) from other goroutines while new versions are
+// being built, without locking.
+//
+// The zero value is an empty tree, ready to use.
+type PersistentTree[K cmp.Ordered, V any] struct {
+	root *node[K, V]
+}
+
+func (n *node[K, V]) clone() *node[K, V] {
+	m := *n
+	return &m
+}
+
+// Same as balance(), but n is assumed to be a fresh copy,
+// and nodes are copied before being rotated.
+func pbalance[K cmp.Ordered, V any](n *node[K, V]) *node[K, V] {
+	n.fix()
+
+	switch bf := height(n.left) - height(n.right); {
+	case bf > 1:
+		n.left = n.left.clone()
+		if height(n.left.left) < height(n.left.right) {
+			n.left.right = n.left.right.clone()
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case bf < -1:
+		n.right = n.right.clone()
+		if height(n.right.right) < height(n.right.left) {
+			n.right.left = n.right.left.clone()
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+// Same as put(), with path copying.
+func pput[K cmp.Ordered, V any](n *node[K, V], k K, v V) *node[K, V] {
+	if n == nil {
+		return &node[K, V]{key: k, value: v, height: 1, size: 1}
+	}
+
+	m := n.clone()
+	switch c := cmp.Compare(k, n.key); {
+	case c < 0:
+		m.left = pput(n.left, k, v)
+	case c > 0:
+		m.right = pput(n.right, k, v)
+	default:
+		m.value = v
+		return m
+	}
+	return pbalance(m)
+}
+
+// Same as deleteMin(), with path copying.
+func pdeleteMin[K cmp.Ordered, V any](n *node[K, V]) (*node[K, V], *node[K, V]) {
+	if n.left == nil {
+		return n.right, n
+	}
+	m := n.clone()
+	var x *node[K, V]
+	m.left, x = pdeleteMin(n.left)
+	return pbalance(m), x
+}
+
+// Same as del(), with path copying; n is returned as-is
+// if k isn't found.
+func pdel[K cmp.Ordered, V any](n *node[K, V], k K) (*node[K, V], bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	var m *node[K, V]
+	switch c := cmp.Compare(k, n.key); {
+	case c < 0:
+		l, deleted := pdel(n.left, k)
+		if !deleted {
+			return n, false
+		}
+		m = n.clone()
+		m.left = l
+	case c > 0:
+		r, deleted := pdel(n.right, k)
+		if !deleted {
+			return n, false
+		}
+		m = n.clone()
+		m.right = r
+	default:
+		if n.left == nil {
+			return n.right, true
+		}
+		if n.right == nil {
+			return n.left, true
+		}
+		// replace n by (a copy of) its successor
+		r, x := pdeleteMin(n.right)
+		m = x.clone()
+		m.left, m.right = n.left, r
+	}
+	return pbalance(m), true
+}
+
+// Insert returns a new tree, where k is associated to v.
+func (t PersistentTree[K, V]) Insert(k K, v V) PersistentTree[K, V] {
+	return PersistentTree[K, V]{pput(t.root, k, v)}
+}
+
+// Delete returns a new tree, without k; if k isn't in t,
+// t is returned.
+func (t PersistentTree[K, V]) Delete(k K) PersistentTree[K, V] {
+	root, _ := pdel(t.root, k)
+	return PersistentTree[K, V]{root}
+}
+
+// Read-only operations are the same as Tree's; the
+// returned *Tree must not be modified.
+func (t PersistentTree[K, V]) view() *Tree[K, V] {
+	return &Tree[K, V]{t.root}
+}
+
+func (t PersistentTree[K, V]) Len() int {
+	return size(t.root)
+}
+
+func (t PersistentTree[K, V]) Get(k K) (V, bool) {
+	return t.view().Get(k)
+}
+
+func (t PersistentTree[K, V]) Min() (K, V, bool) {
+	return t.view().Min()
+}
+
+func (t PersistentTree[K, V]) Max() (K, V, bool) {
+	return t.view().Max()
+}
+
+func (t PersistentTree[K, V]) Floor(k K) (K, V, bool) {
+	return t.view().Floor(k)
+}
+
+func (t PersistentTree[K, V]) Ceiling(k K) (K, V, bool) {
+	return t.view().Ceiling(k)
+}
+
+func (t PersistentTree[K, V]) Rank(k K) int {
+	return t.view().Rank(k)
+}
+
+func (t PersistentTree[K, V]) Select(i int) (K, V, bool) {
+	return t.view().Select(i)
+}
+
+func (t PersistentTree[K, V]) CountRange(lo, hi K) int {
+	return t.view().CountRange(lo, hi)
+}
+
+// Unlike Tree's, iterators remain valid while new versions
+// are being built.
+func (t PersistentTree[K, V]) Range(lo, hi K) iter.Seq2[K, V] {
+	return t.view().Range(lo, hi)
+}
+
+func (t PersistentTree[K, V]) All() iter.Seq2[K, V] {
+	return t.view().All()
+}
+
+func (t PersistentTree[K, V]) Backward() iter.Seq2[K, V] {
+	return t.view().Backward()
+}
+
+func (t PersistentTree[K, V]) Keys() iter.Seq[K] {
+	return t.view().Keys()
+}
+
+func (t PersistentTree[K, V]) String() string {
+	return t.view().String()
+}
+
+func (t PersistentTree[K, V]) PreOrder() iter.Seq2[K, V] {
+	return t.view().PreOrder()
+}
+
+func (t PersistentTree[K, V]) LevelOrder() iter.Seq2[K, V] {
+	return t.view().LevelOrder()
+}
+
+func (t PersistentTree[K, V]) Dot(w io.Writer) error {
+	return t.view().Dot(w)
+}
+
+func (t PersistentTree[K, V]) Sideways(w io.Writer) error {
+	return t.view().Sideways(w)
+}
+
+func (t PersistentTree[K, V]) Encode(w io.Writer) error {
+	return t.view().Encode(w)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cmp"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Collects the nodes of a tree
+func nodes[K cmp.Ordered, V any](n *node[K, V], m map[*node[K, V]]bool) {
+	if n != nil {
+		m[n] = true
+		nodes(n.left, m)
+		nodes(n.right, m)
+	}
+}
+
+func TestPersistentTreeVersions(t *testing.T) {
+	var versions []PersistentTree[int, int]
+	var strs []string
+	var refs []map[int]int
+
+	r := rand.New(rand.NewPCG(5, 6))
+	p := PersistentTree[int, int]{}
+	ref := make(map[int]int)
+
+	for i := 0; i < 500; i++ {
+		k := r.IntN(200)
+		if r.IntN(3) == 0 {
+			p = p.Delete(k)
+			delete(ref, k)
+		} else {
+			p = p.Insert(k, i)
+			ref[k] = i
+		}
+
+		versions = append(versions, p)
+		strs = append(strs, p.String())
+		refs = append(refs, maps.Clone(ref))
+	}
+
+	// Old versions are left untouched by further updates
+	for i, v := range versions {
+		checkNode(t, v.root, nil, nil)
+		if v.String() != strs[i] || v.Len() != len(refs[i]) {
+			t.Fatalf("version %d altered: %s ≠ %s", i, v, strs[i])
+		}
+		for k, x := range v.All() {
+			if refs[i][k] != x {
+				t.Fatalf("version %d altered: %d: %d ≠ %d", i, k, x, refs[i][k])
+			}
+		}
+	}
+}
+
+func TestPersistentTreeSharing(t *testing.T) {
+	p := PersistentTree[int, string]{}
+	for i := range 1000 {
+		p = p.Insert(i, "")
+	}
+
+	q := p.Insert(1000, "").Delete(500).Insert(0, "updated")
+
+	m, n := make(map[*node[int, string]]bool), make(map[*node[int, string]]bool)
+	nodes(p.root, m)
+	nodes(q.root, n)
+
+	shared := 0
+	for x := range n {
+		if m[x] {
+			shared++
+		}
+	}
+
+	// Each update copies O(log n) nodes
+	if shared < 1000-3*3*12 {
+		t.Errorf("Only %d shared nodes", shared)
+	}
+
+	if v, _ := p.Get(0); v != "" {
+		t.Errorf("Original altered")
+	}
+	if v, _ := q.Get(0); v != "updated" {
+		t.Errorf("Update lost")
+	}
+	if _, ok := p.Get(500); !ok {
+		t.Errorf("Original altered")
+	}
+
+	// deleting a missing key is free
+	if r := q.Delete(500); r.root != q.root {
+		t.Errorf("Deleting a missing key shouldn't copy anything")
+	}
+}
+
+// To be run with -race
+func TestPersistentTreeConcurrentReaders(t *testing.T) {
+	p := PersistentTree[int, int]{}
+	for i := range 100 {
+		p = p.Insert(i, i)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func(p PersistentTree[int, int]) {
+			defer wg.Done()
+			for range 20 {
+				ks := slices.Collect(p.Keys())
+				if len(ks) != 100 || !slices.IsSorted(ks) {
+					t.Errorf("Snapshot altered")
+					return
+				}
+			}
+		}(p)
+	}
+
+	for i := range 200 {
+		p = p.Insert(i+100, i).Delete(i)
+	}
+	wg.Wait()
+
+	checkNode(t, p.root, nil, nil)
+	if p.Len() != 100 {
+		t.Errorf("Len() = %d ≠ 100", p.Len())
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+// bufio.SplitFunc for Unicode text segmentation, loosely following
+// UAX #29[0]: grapheme clusters, words and sentences. Only what
+// can be derived from the standard library's unicode tables is
+// implemented, which should be good enough for counting.
+//
+// As for bufio.ScanWords, segments that aren't of interest (spaces,
+// punctuation) are skipped.
+//
+// When more input is needed to locate a boundary, (0, nil, nil)
+// is returned, and SplitCounter will save what remains for later.
+//
+// [0]: https://www.unicode.org/reports/tr29/
+
+import (
+	"bufio"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Turns a bufio.SplitFunc returning segments to be skipped as
+// (n > 0, nil, nil) into one skipping them: bufio.Scanner stops
+// at EOF as soon as no token is returned.
+func skipping(f bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		start := 0
+		for start < len(data) {
+			n, token, err := f(data[start:], atEOF)
+			if err != nil || n == 0 {
+				return start, nil, err
+			}
+			if token != nil {
+				return start + n, token, nil
+			}
+			start += n
+		}
+		return start, nil, nil
+	}
+}
+
+// Decodes the rune at the start of data; ok is false if more
+// data is needed to decode it.
+func peekRune(data []byte, atEOF bool) (r rune, size int, ok bool) {
+	if len(data) == 0 || (!atEOF && !utf8.FullRune(data)) {
+		return 0, 0, false
+	}
+	r, size = utf8.DecodeRune(data)
+	return r, size, true
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// Extended_Pictographic, roughly
+func isPictographic(r rune) bool {
+	return (r >= 0x1f000 && r <= 0x1faff) || (r >= 0x2600 && r <= 0x27bf)
+}
+
+// Grapheme_Extend, plus emoji modifiers and spacing marks
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		(r >= 0x1f3fb && r <= 0x1f3ff) || r == 0x200d
+}
+
+// Hangul jamo: leading consonants, vowels, trailing consonants
+const (
+	hangulL = iota + 1
+	hangulV
+	hangulT
+	hangulLV
+	hangulLVT
+)
+
+func hangulType(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f, r >= 0xa960 && r <= 0xa97c:
+		return hangulL
+	case r >= 0x1160 && r <= 0x11a7, r >= 0xd7b0 && r <= 0xd7c6:
+		return hangulV
+	case r >= 0x11a8 && r <= 0x11ff, r >= 0xd7cb && r <= 0xd7fb:
+		return hangulT
+	case r >= 0xac00 && r <= 0xd7a3:
+		if (r-0xac00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	}
+	return 0
+}
+
+// Whether there's no grapheme cluster boundary between a and b
+// (GB6-GB8, for Hangul syllables).
+func hangulJoins(a, b int) bool {
+	switch a {
+	case hangulL:
+		return b != 0 && b != hangulT
+	case hangulV, hangulLV:
+		return b == hangulV || b == hangulT
+	case hangulT, hangulLVT:
+		return b == hangulT
+	}
+	return false
+}
+
+// ScanGraphemes is a bufio.SplitFunc returning extended grapheme
+// clusters, i.e. user-perceived characters, e.g. "é" written as
+// "e" followed by a combining acute accent, or a flag (a pair of
+// regional indicators).
+func ScanGraphemes(data []byte, atEOF bool) (int, []byte, error) {
+	r, n, ok := peekRune(data, atEOF)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	// GB3, GB4, GB5
+	if r == '\r' || r == '\n' || unicode.Is(unicode.Cc, r) {
+		if r == '\r' {
+			if len(data) == n && !atEOF {
+				return 0, nil, nil
+			}
+			if len(data) > n && data[n] == '\n' {
+				n++
+			}
+		}
+		return n, data[:n], nil
+	}
+
+	prev, ri := r, 0
+	if isRegionalIndicator(r) {
+		ri = 1
+	}
+	pict := isPictographic(r)
+
+	for {
+		r, m, ok := peekRune(data[n:], atEOF)
+		if !ok {
+			if atEOF {
+				return n, data[:n], nil
+			}
+			return 0, nil, nil
+		}
+
+		switch {
+		// GB9, GB9a; an emoji ZWJ sequence keeps going (GB11)
+		case isGraphemeExtend(r):
+		case hangulJoins(hangulType(prev), hangulType(r)):
+		// GB11
+		case prev == 0x200d && pict && isPictographic(r):
+		// GB12, GB13
+		case ri%2 == 1 && isRegionalIndicator(r):
+		default:
+			return n, data[:n], nil
+		}
+
+		if isRegionalIndicator(r) {
+			ri++
+		}
+		n += m
+		prev = r
+	}
+}
+
+// Word_Break property values (see UAX #29, table 3).
+const (
+	wbOther = iota
+	wbCR
+	wbNewline // LF included
+	wbExtend  // Extend, Format and ZWJ
+	wbRegionalIndicator
+	wbKatakana
+	wbHiragana // Other, but still a word on its own
+	wbIdeographic
+	wbALetter
+	wbMidLetter
+	wbMidNum
+	wbMidNumLet
+	wbNumeric
+	wbExtendNumLet
+	wbWSegSpace
+)
+
+func wordBreakType(r rune) int {
+	switch r {
+	case '\r':
+		return wbCR
+	case '\n', '\v', '\f', 0x85, 0x2028, 0x2029:
+		return wbNewline
+	case ':', 0xb7, 0x387, 0x5f4, 0x2027, 0xfe13, 0xfe55, 0xff1a:
+		return wbMidLetter
+	case ',', ';', 0x37e, 0x589, 0x60c, 0x60d, 0x66c, 0x7f8, 0x2044,
+		0xfe10, 0xfe14, 0xfe50, 0xfe54, 0xff0c, 0xff1b:
+		return wbMidNum
+	case '.', '\'', 0x2018, 0x2019, 0x2024, 0xfe52, 0xff07, 0xff0e:
+		return wbMidNumLet
+	case 0x30fc: // prolonged sound mark
+		return wbKatakana
+	}
+
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc, unicode.Cf):
+		return wbExtend
+	case isRegionalIndicator(r):
+		return wbRegionalIndicator
+	case unicode.Is(unicode.Katakana, r):
+		return wbKatakana
+	case unicode.Is(unicode.Hiragana, r):
+		return wbHiragana
+	case unicode.Is(unicode.Han, r):
+		return wbIdeographic
+	case unicode.IsLetter(r):
+		return wbALetter
+	case unicode.Is(unicode.Nd, r):
+		return wbNumeric
+	case unicode.Is(unicode.Pc, r):
+		return wbExtendNumLet
+	case unicode.Is(unicode.Zs, r):
+		return wbWSegSpace
+	}
+	return wbOther
+}
+
+// Word_Break of the first rune of data not being Extend
+// (WB4), and its offset; ok is false if more data is needed.
+func nextWordBreakType(data []byte, atEOF bool) (wb int, off int, size int, ok bool) {
+	for {
+		r, n, ok := peekRune(data[off:], atEOF)
+		if !ok {
+			return wbOther, off, 0, atEOF && off == len(data)
+		}
+		if wb = wordBreakType(r); wb != wbExtend {
+			return wb, off, n, true
+		}
+		off += n
+	}
+}
+
+// Whether there's no word boundary between a and b (WB5 to
+// WB13b, not considering the Mid* cases).
+func wordJoins(a, b int) bool {
+	switch {
+	case (a == wbALetter || a == wbNumeric) && (b == wbALetter || b == wbNumeric):
+		return true
+	case a == wbKatakana && b == wbKatakana:
+		return true
+	case b == wbExtendNumLet:
+		return a == wbALetter || a == wbNumeric || a == wbKatakana || a == wbExtendNumLet
+	case a == wbExtendNumLet:
+		return b == wbALetter || b == wbNumeric || b == wbKatakana
+	}
+	return false
+}
+
+// ScanUnicodeWords is a bufio.SplitFunc returning words as
+// delimited by UAX #29: e.g. "can't", "3.14" and "e.g" are words,
+// and each Han ideograph or Hiragana character is a word of its
+// own (there's no dictionary-based segmentation). Segments without
+// letters, digits or ideographs are skipped.
+func ScanUnicodeWords(data []byte, atEOF bool) (int, []byte, error) {
+	return skipping(scanWordSegment)(data, atEOF)
+}
+
+// Next word segment; not a word: (n > 0, nil, nil)
+func scanWordSegment(data []byte, atEOF bool) (int, []byte, error) {
+	r, n, ok := peekRune(data, atEOF)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	prev := wordBreakType(r)
+	isWord := false
+	switch prev {
+	case wbKatakana, wbHiragana, wbIdeographic, wbALetter, wbNumeric, wbExtendNumLet:
+		isWord = true
+	}
+
+	// WB3, WB3a, WB3b
+	switch prev {
+	case wbCR:
+		if len(data) == n && !atEOF {
+			return 0, nil, nil
+		}
+		if len(data) > n && data[n] == '\n' {
+			n++
+		}
+		return n, nil, nil
+	case wbNewline:
+		return n, nil, nil
+	}
+
+	ri := 0
+	if prev == wbRegionalIndicator {
+		ri = 1
+	}
+
+	token := func(n int) (int, []byte, error) {
+		if isWord {
+			return n, data[:n], nil
+		}
+		return n, nil, nil
+	}
+
+	for {
+		wb, off, m, ok := nextWordBreakType(data[n:], atEOF)
+		if !ok {
+			return 0, nil, nil
+		}
+		if m == 0 {
+			// end of data, at EOF
+			return token(len(data))
+		}
+		// Extend/Format characters are attached to what precedes
+		// them (WB4), but they can't be followed by a newline,
+		// which is handled on its own (WB3a/b).
+		if wb == wbCR || wb == wbNewline {
+			return token(n + off)
+		}
+
+		switch {
+		case prev == wbWSegSpace && wb == wbWSegSpace: // WB3d
+		case wordJoins(prev, wb):
+		// WB6, WB7, WB11, WB12
+		case (prev == wbALetter && (wb == wbMidLetter || wb == wbMidNumLet)) ||
+			(prev == wbNumeric && (wb == wbMidNum || wb == wbMidNumLet)):
+			next, off2, m2, ok := nextWordBreakType(data[n+off+m:], atEOF)
+			if !ok {
+				return 0, nil, nil
+			}
+			if m2 == 0 || next != prev {
+				return token(n + off)
+			}
+			n += off + m + off2 + m2
+			continue
+		// WB15, WB16
+		case prev == wbRegionalIndicator && wb == wbRegionalIndicator && ri%2 == 1:
+			ri++
+		default:
+			return token(n + off)
+		}
+
+		n += off + m
+		prev = wb
+	}
+}
+
+// Sentence_Break property values, roughly (see UAX #29, table 4).
+const (
+	sbOther = iota
+	sbSep
+	sbSp
+	sbLower
+	sbUpper
+	sbOLetter
+	sbNumeric
+	sbATerm
+	sbSTerm
+	sbClose
+)
+
+func sentenceBreakType(r rune) int {
+	switch r {
+	case '\n', '\r', 0x85, 0x2028, 0x2029:
+		return sbSep
+	case '.', 0x2024, 0xfe52, 0xff0e:
+		return sbATerm
+	case '!', '?', 0x589, 0x61f, 0x6d4, 0x964, 0x965, 0x203c, 0x203d,
+		0x2047, 0x2048, 0x2049, 0x3002, 0xfe56, 0xfe57, 0xff01, 0xff1f, 0xff61:
+		return sbSTerm
+	case '"', '\'', 0xab, 0xbb:
+		return sbClose
+	}
+
+	switch {
+	case unicode.IsSpace(r):
+		return sbSp
+	case unicode.IsLower(r):
+		return sbLower
+	case unicode.IsUpper(r) || unicode.IsTitle(r):
+		return sbUpper
+	case unicode.IsLetter(r):
+		return sbOLetter
+	case unicode.Is(unicode.Nd, r):
+		return sbNumeric
+	case unicode.In(r, unicode.Ps, unicode.Pe, unicode.Pi, unicode.Pf):
+		return sbClose
+	}
+	return sbOther
+}
+
+// ScanSentences is a bufio.SplitFunc returning sentences, as
+// delimited by UAX #29, with a few simplifications:
+//
+//	- a sentence ends after a terminator ('.', '!', '?', '。', etc.),
+//	optionally followed by closing punctuation, and spaces;
+//	- a '.' followed by a lowercase word or a digit doesn't end a
+//	sentence (e.g. "etc. and", "3.14"), nor does a '.' between two
+//	uppercase letters (e.g. "U.S.A.");
+//	- a single line break doesn't end a sentence, so that wrapped
+//	text can be handled; an empty line (paragraph) does.
+//
+// Segments without letters or digits are skipped.
+func ScanSentences(data []byte, atEOF bool) (int, []byte, error) {
+	return skipping(scanSentenceSegment)(data, atEOF)
+}
+
+// Next sentence segment; no letters or digits: (n > 0, nil, nil)
+func scanSentenceSegment(data []byte, atEOF bool) (int, []byte, error) {
+	n := 0
+	prev, hasText, nl := sbOther, false, 0
+
+	token := func(n int) (int, []byte, error) {
+		if hasText {
+			return n, data[:n], nil
+		}
+		return n, nil, nil
+	}
+
+	for {
+		r, m, ok := peekRune(data[n:], atEOF)
+		if !ok {
+			if atEOF && n > 0 {
+				return token(n)
+			}
+			return 0, nil, nil
+		}
+		sb := sentenceBreakType(r)
+
+		// paragraph break
+		if sb == sbSep && r != '\r' {
+			if nl++; nl > 1 {
+				return token(n + m)
+			}
+		} else if sb != sbSp {
+			nl = 0
+		}
+
+		if sb != sbATerm && sb != sbSTerm {
+			if sb == sbLower || sb == sbUpper || sb == sbOLetter || sb == sbNumeric {
+				hasText = true
+			}
+			n += m
+			prev = sb
+			continue
+		}
+
+		// Terminator: skip closing punctuation, then spaces,
+		// then look at what follows.
+		term, before := sb, prev
+		end := n + m
+		for {
+			r, m, ok := peekRune(data[end:], atEOF)
+			if !ok {
+				if atEOF {
+					return token(len(data))
+				}
+				return 0, nil, nil
+			}
+			if c := sentenceBreakType(r); c != sbClose && !(c == term && term == sbSTerm) {
+				break
+			}
+			end += m
+		}
+
+		spaces := end
+		for {
+			r, m, ok := peekRune(data[spaces:], atEOF)
+			if !ok {
+				if atEOF {
+					return token(len(data))
+				}
+				return 0, nil, nil
+			}
+			if c := sentenceBreakType(r); c != sbSp && c != sbSep {
+				break
+			}
+			spaces += m
+		}
+
+		// what follows, ignoring other punctuation
+		next := spaces
+		var nsb int
+		for {
+			r, m, ok := peekRune(data[next:], atEOF)
+			if !ok {
+				if atEOF {
+					return token(len(data))
+				}
+				return 0, nil, nil
+			}
+			nsb = sentenceBreakType(r)
+			if nsb != sbOther && nsb != sbClose {
+				break
+			}
+			next += m
+		}
+
+		switch {
+		// CJK terminators need no spaces
+		case term == sbSTerm:
+		case nsb == sbNumeric && spaces == end: // SB6
+			n = end
+			prev = nsb
+			continue
+		case before == sbUpper && nsb == sbUpper && spaces == end: // SB7
+			n = end
+			prev = sbUpper
+			continue
+		case nsb == sbLower: // SB8
+			n = end
+			prev = sbOther
+			continue
+		case spaces == end && nsb != sbSep && nsb != sbSp:
+			// e.g. "foo.bar"
+			n = end
+			prev = sbOther
+			continue
+		}
+
+		// SB11: break after the spaces; a paragraph break in
+		// there is part of this sentence.
+		return token(spaces)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func scanAll(s string, f bufio.SplitFunc) []string {
+	var xs []string
+	sc := bufio.NewScanner(strings.NewReader(s))
+	sc.Split(f)
+	for sc.Scan() {
+		xs = append(xs, sc.Text())
+	}
+	return xs
+}
+
+// Writes s one byte at a time, so that every possible split
+// of the input is exercised.
+func writeBytes(w io.Writer, s string) {
+	for i := range len(s) {
+		w.Write([]byte{s[i]})
+	}
+}
+
+func TestScanGraphemes(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		out []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"été", []string{"é", "t", "é"}},
+		{"a\r\nb", []string{"a", "\r\n", "b"}},
+		{"🇫🇷🇯🇵", []string{"🇫🇷", "🇯🇵"}},
+		{"👍🏽!", []string{"👍🏽", "!"}},
+		{"👩‍💻x", []string{"👩‍💻", "x"}},
+		{"각각", []string{"각", "각"}},
+	} {
+		if xs := scanAll(c.in, ScanGraphemes); !slices.Equal(xs, c.out) {
+			t.Errorf("%q: %q ≠ %q", c.in, xs, c.out)
+		}
+	}
+}
+
+func TestScanUnicodeWords(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		out []string
+	}{
+		{"Hello, world!", []string{"Hello", "world"}},
+		{"can't stop 3.14 e.g. 1,000", []string{"can't", "stop", "3.14", "e.g", "1,000"}},
+		{"snake_case foo. bar", []string{"snake_case", "foo", "bar"}},
+		{"日本語のテキスト", []string{"日", "本", "語", "の", "テキスト"}},
+		{"café́ naïve", []string{"café́", "naïve"}},
+		{"a\r\nb\n\nc", []string{"a", "b", "c"}},
+		{"  ...  ", nil},
+	} {
+		if xs := scanAll(c.in, ScanUnicodeWords); !slices.Equal(xs, c.out) {
+			t.Errorf("%q: %q ≠ %q", c.in, xs, c.out)
+		}
+	}
+}
+
+func TestScanSentences(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		out []string
+	}{
+		{"Hello there. How are you? Fine!", []string{"Hello there. ", "How are you? ", "Fine!"}},
+		{"It costs 3.14 dollars, etc. and more. Next", []string{"It costs 3.14 dollars, etc. and more. ", "Next"}},
+		{"The U.S.A. is big.", []string{"The U.S.A. is big."}},
+		{"He said \"Stop.\" Then left.", []string{"He said \"Stop.\" ", "Then left."}},
+		{"A title\n\nSome text\nwrapped.", []string{"A title\n\n", "Some text\nwrapped."}},
+		{"你好。我很好！", []string{"你好。", "我很好！"}},
+		{"... !!", nil},
+	} {
+		if xs := scanAll(c.in, ScanSentences); !slices.Equal(xs, c.out) {
+			t.Errorf("%q: %q ≠ %q", c.in, xs, c.out)
+		}
+	}
+}
+
+// Counters should give the same results however the input
+// is split between calls to Write.
+func TestUnicodeCounters(t *testing.T) {
+	s := "Un café́, s'il vous plaît. 日本語のテキストです。🇫🇷 Voilà!\n"
+
+	g := &GraphemeCounter{}
+	writeBytes(g, s)
+	g.Flush()
+
+	w := &UnicodeWordCounter{}
+	writeBytes(w, s)
+	w.Flush()
+
+	c := &SentenceCounter{}
+	writeBytes(c, s)
+	c.Flush()
+
+	if n := len(scanAll(s, ScanGraphemes)); g.Count() != int64(n) || n != 46 {
+		t.Errorf("graphemes: %d, %d ≠ 46", g.Count(), n)
+	}
+	if n := len(scanAll(s, ScanUnicodeWords)); w.Count() != int64(n) || n != 13 {
+		t.Errorf("words: %d, %d ≠ 13", w.Count(), n)
+	}
+	if n := len(scanAll(s, ScanSentences)); c.Count() != int64(n) || n != 3 {
+		t.Errorf("sentences: %d, %d ≠ 3", c.Count(), n)
+	}
+}
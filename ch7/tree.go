@@ -2,22 +2,53 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"strconv"
 )
 
+// Tree is an ordered map, implemented as an AVL tree: the heights
+// of the two subtrees of any node differ by at most one, so that
+// the height of the tree stays O(log n), even for sorted input.
+//
+// Nodes are augmented with the size of their subtree, which
+// allows order-statistics (Rank(), Select()) in O(log n).
+//
+// The zero value is an empty tree, ready to use.
+type Tree[K cmp.Ordered, V any] struct {
+	root *node[K, V]
+}
+
+type node[K cmp.Ordered, V any] struct {
+	key         K
+	value       V
+	left, right *node[K, V]
+
+	// height of the subtree rooted at this node; a leaf has
+	// height 1, a nil node height 0.
+	height int
+
+	// number of nodes in the subtree rooted at this node
+	size int
+}
+
+// The original (unbalanced, int-only) tree from gopl.io/ch4/treesort,
+// kept for compatibility: values are keys, mapped to their number
+// of occurrences, so that duplicates are kept, as treesort needs.
 type tree struct {
-	value int
-	left, right *tree
+	Tree[int, int]
 }
+
 func add(t *tree, value int) *tree {
 	if t == nil {
-		return &tree{value: value}
-	}
-	if value < t.value {
-		t.left = add(t.left, value)
-	} else {
-		t.right = add(t.right, value)
+		t = &tree{}
 	}
+	n, _ := t.Get(value)
+	t.Put(value, n+1)
 	return t
 }
 
@@ -28,26 +59,620 @@ func addAll(t *tree, values ...int) *tree {
 	return t
 }
 
+func height[K cmp.Ordered, V any](n *node[K, V]) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func size[K cmp.Ordered, V any](n *node[K, V]) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// Updates n's height and size, assuming its children's
+// are correct.
+func (n *node[K, V]) fix() {
+	n.height = 1 + max(height(n.left), height(n.right))
+	n.size = 1 + size(n.left) + size(n.right)
+}
+
+//	    n            l
+//	   / \          / \
+//	  l   c   =>   a   n
+//	 / \              / \
+//	a   b            b   c
+func rotateRight[K cmp.Ordered, V any](n *node[K, V]) *node[K, V] {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.fix()
+	l.fix()
+	return l
+}
+
+func rotateLeft[K cmp.Ordered, V any](n *node[K, V]) *node[K, V] {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.fix()
+	r.fix()
+	return r
+}
+
+// Restores the AVL property at n, assuming it holds for
+// both its subtrees, and that their heights differ by at
+// most 2; returns the new root of the subtree.
+func balance[K cmp.Ordered, V any](n *node[K, V]) *node[K, V] {
+	n.fix()
+
+	switch bf := height(n.left) - height(n.right); {
+	case bf > 1:
+		if height(n.left.left) < height(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case bf < -1:
+		if height(n.right.right) < height(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+// Inserts or updates k in the subtree rooted at n; returns the
+// new root, and whether a node was added.
+func put[K cmp.Ordered, V any](n *node[K, V], k K, v V) (*node[K, V], bool) {
+	if n == nil {
+		return &node[K, V]{key: k, value: v, height: 1, size: 1}, true
+	}
+
+	var added bool
+	switch c := cmp.Compare(k, n.key); {
+	case c < 0:
+		n.left, added = put(n.left, k, v)
+	case c > 0:
+		n.right, added = put(n.right, k, v)
+	default:
+		n.value = v
+		return n, false
+	}
+	return balance(n), added
+}
+
+// Removes the smallest node of the subtree rooted at n; returns
+// the new root, and the removed node.
+func deleteMin[K cmp.Ordered, V any](n *node[K, V]) (*node[K, V], *node[K, V]) {
+	if n.left == nil {
+		return n.right, n
+	}
+	var m *node[K, V]
+	n.left, m = deleteMin(n.left)
+	return balance(n), m
+}
+
+// Removes k from the subtree rooted at n; returns the new root,
+// and whether a node was removed.
+func del[K cmp.Ordered, V any](n *node[K, V], k K) (*node[K, V], bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	var deleted bool
+	switch c := cmp.Compare(k, n.key); {
+	case c < 0:
+		n.left, deleted = del(n.left, k)
+	case c > 0:
+		n.right, deleted = del(n.right, k)
+	default:
+		if n.left == nil {
+			return n.right, true
+		}
+		if n.right == nil {
+			return n.left, true
+		}
+		// replace n by its successor
+		var m *node[K, V]
+		n.right, m = deleteMin(n.right)
+		m.left, m.right = n.left, n.right
+		return balance(m), true
+	}
+	return balance(n), deleted
+}
+
+func (t *Tree[K, V]) Len() int {
+	return size(t.root)
+}
+
+// Put associates v to k, replacing any previous value.
+func (t *Tree[K, V]) Put(k K, v V) {
+	t.root, _ = put(t.root, k, v)
+}
+
+func (t *Tree[K, V]) Get(k K) (V, bool) {
+	for n := t.root; n != nil; {
+		switch c := cmp.Compare(k, n.key); {
+		case c < 0:
+			n = n.left
+		case c > 0:
+			n = n.right
+		default:
+			return n.value, true
+		}
+	}
+	var v V
+	return v, false
+}
+
+// Delete removes k; reports whether k was in t.
+func (t *Tree[K, V]) Delete(k K) bool {
+	var deleted bool
+	t.root, deleted = del(t.root, k)
+	return deleted
+}
+
+// Returns the key and value of n, if not nil.
+func (n *node[K, V]) entry() (K, V, bool) {
+	if n == nil {
+		var k K
+		var v V
+		return k, v, false
+	}
+	return n.key, n.value, true
+}
+
+// Min returns the smallest key, and its value.
+func (t *Tree[K, V]) Min() (K, V, bool) {
+	n := t.root
+	for n != nil && n.left != nil {
+		n = n.left
+	}
+	return n.entry()
+}
+
+// Max returns the largest key, and its value.
+func (t *Tree[K, V]) Max() (K, V, bool) {
+	n := t.root
+	for n != nil && n.right != nil {
+		n = n.right
+	}
+	return n.entry()
+}
+
+// Floor returns the largest key ≤ k, and its value.
+func (t *Tree[K, V]) Floor(k K) (K, V, bool) {
+	var m *node[K, V]
+	for n := t.root; n != nil; {
+		switch c := cmp.Compare(k, n.key); {
+		case c < 0:
+			n = n.left
+		case c > 0:
+			m, n = n, n.right
+		default:
+			return n.entry()
+		}
+	}
+	return m.entry()
+}
+
+// Ceiling returns the smallest key ≥ k, and its value.
+func (t *Tree[K, V]) Ceiling(k K) (K, V, bool) {
+	var m *node[K, V]
+	for n := t.root; n != nil; {
+		switch c := cmp.Compare(k, n.key); {
+		case c < 0:
+			m, n = n, n.left
+		case c > 0:
+			n = n.right
+		default:
+			return n.entry()
+		}
+	}
+	return m.entry()
+}
+
+// Rank returns the number of keys < k (k needs not be
+// in t).
+func (t *Tree[K, V]) Rank(k K) int {
+	r := 0
+	for n := t.root; n != nil; {
+		switch c := cmp.Compare(k, n.key); {
+		case c < 0:
+			n = n.left
+		case c > 0:
+			r += size(n.left) + 1
+			n = n.right
+		default:
+			return r + size(n.left)
+		}
+	}
+	return r
+}
+
+// Select returns the i-th smallest key (from 0), and its value.
+func (t *Tree[K, V]) Select(i int) (K, V, bool) {
+	n := t.root
+	for n != nil {
+		switch l := size(n.left); {
+		case i < l:
+			n = n.left
+		case i > l:
+			i -= l + 1
+			n = n.right
+		default:
+			return n.entry()
+		}
+	}
+	return n.entry()
+}
+
+// CountRange returns the number of keys in [lo, hi).
+func (t *Tree[K, V]) CountRange(lo, hi K) int {
+	if cmp.Compare(hi, lo) <= 0 {
+		return 0
+	}
+	return t.Rank(hi) - t.Rank(lo)
+}
+
+// Range iterates on the keys in [lo, hi), in increasing order;
+// this is O(log n) plus the number of keys iterated on.
+func (t *Tree[K, V]) Range(lo, hi K) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		// Nodes ≥ lo on the path to lo: those are the
+		// ones we'd have stacked in All() once reaching lo.
+		var stack []*node[K, V]
+		for n := t.root; n != nil; {
+			if cmp.Less(n.key, lo) {
+				n = n.right
+			} else {
+				stack = append(stack, n)
+				n = n.left
+			}
+		}
+
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !cmp.Less(n.key, hi) || !yield(n.key, n.value) {
+				return
+			}
+			for n = n.right; n != nil; n = n.left {
+				stack = append(stack, n)
+			}
+		}
+	}
+}
+
+// All iterates on the tree, in increasing key order.
+//
+// NOTE: t must not be modified while iterating.
+func (t *Tree[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		var stack []*node[K, V]
+		for n := t.root; n != nil || len(stack) > 0; n = n.right {
+			for ; n != nil; n = n.left {
+				stack = append(stack, n)
+			}
+			n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			if !yield(n.key, n.value) {
+				return
+			}
+		}
+	}
+}
+
+// Backward iterates on the tree, in decreasing key order.
+func (t *Tree[K, V]) Backward() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		var stack []*node[K, V]
+		for n := t.root; n != nil || len(stack) > 0; n = n.left {
+			for ; n != nil; n = n.right {
+				stack = append(stack, n)
+			}
+			n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			if !yield(n.key, n.value) {
+				return
+			}
+		}
+	}
+}
+
+// Keys iterates on the keys, in increasing order.
+func (t *Tree[K, V]) Keys() iter.Seq[K] {
+	return func(yield func(K) bool) {
+		for k := range t.All() {
+			if !yield(k) {
+				return
+			}
+		}
+	}
+}
+
 // « Write a String method for the *tree type in
 // gopl.io/ch4/treesort (§4.4) reveals the sequence
 // of values in the tre e. »
-func (t *tree) String() string {
+//
+// Now iterative: no more recursion as deep as the tree.
+func (t *Tree[K, V]) String() string {
 	var b bytes.Buffer
 
 	if t == nil {
 		return ""
 	}
 
-	// != nil guards only for space display control then.
-	if t.left != nil {
-		b.WriteString(t.left.String())
-		b.WriteByte(' ')
+	first := true
+	for k := range t.Keys() {
+		if !first {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%v", k)
+		first = false
 	}
-	fmt.Fprintf(&b, "%d", t.value)
-	if t.right != nil {
-		b.WriteByte(' ')
-		b.WriteString(t.right.String())
+
+	return b.String()
+}
+
+// As the original: each value, as many times as it was added.
+func (t *tree) String() string {
+	var b bytes.Buffer
+
+	if t == nil {
+		return ""
+	}
+
+	for k, n := range t.All() {
+		for i := 0; i < n; i++ {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(&b, "%d", k)
+		}
 	}
 
 	return b.String()
 }
+
+// PreOrder iterates on the tree in pre-order (node, then
+// left subtree, then right subtree).
+func (t *Tree[K, V]) PreOrder() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for n := range t.preOrderNodes() {
+			if !yield(n.key, n.value) {
+				return
+			}
+		}
+	}
+}
+
+// LevelOrder iterates on the tree level by level (breadth-first),
+// from left to right.
+func (t *Tree[K, V]) LevelOrder() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		var queue []*node[K, V]
+		if t.root != nil {
+			queue = append(queue, t.root)
+		}
+		for len(queue) > 0 {
+			n := queue[0]
+			queue = queue[1:]
+			if !yield(n.key, n.value) {
+				return
+			}
+			if n.left != nil {
+				queue = append(queue, n.left)
+			}
+			if n.right != nil {
+				queue = append(queue, n.right)
+			}
+		}
+	}
+}
+
+// Dot writes the tree in Graphviz's dot format, e.g.
+//
+//	go run ... | dot -Tpng > tree.png
+//
+// Missing children are drawn as points, so that a lone child
+// can be told to be a left or a right one.
+func (t *Tree[K, V]) Dot(w io.Writer) error {
+	var b bytes.Buffer
+
+	b.WriteString("digraph tree {\n")
+	b.WriteString("\tnode [shape=circle];\n")
+
+	// nodes are numbered in pre-order
+	i := 0
+	var dot func(n *node[K, V]) int
+	dot = func(n *node[K, V]) int {
+		id := i
+		i++
+		if n == nil {
+			fmt.Fprintf(&b, "\tn%d [shape=point];\n", id)
+			return id
+		}
+		fmt.Fprintf(&b, "\tn%d [label=%s];\n", id, strconv.Quote(fmt.Sprint(n.key)))
+		if n.left != nil || n.right != nil {
+			fmt.Fprintf(&b, "\tn%d -> n%d;\n", id, dot(n.left))
+			fmt.Fprintf(&b, "\tn%d -> n%d;\n", id, dot(n.right))
+		}
+		return id
+	}
+	if t.root != nil {
+		dot(t.root)
+	}
+
+	b.WriteString("}\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// Sideways writes the tree rotated 90° counter-clockwise, root
+// on the left, right subtree above it, e.g. for 1..5:
+//
+//	    /-- 5
+//	/-- 4
+//	|   \-- 3
+//	2
+//	\-- 1
+func (t *Tree[K, V]) Sideways(w io.Writer) error {
+	var b bytes.Buffer
+
+	var sideways func(n *node[K, V], prefix string, left bool)
+	sideways = func(n *node[K, V], prefix string, left bool) {
+		branch, up, down := "/-- ", "    ", "|   "
+		if left {
+			branch, up, down = "\\-- ", "|   ", "    "
+		}
+		if n.right != nil {
+			sideways(n.right, prefix+up, false)
+		}
+		fmt.Fprintf(&b, "%s%s%v\n", prefix, branch, n.key)
+		if n.left != nil {
+			sideways(n.left, prefix+down, true)
+		}
+	}
+
+	if n := t.root; n != nil {
+		if n.right != nil {
+			sideways(n.right, "", false)
+		}
+		fmt.Fprintf(&b, "%v\n", n.key)
+		if n.left != nil {
+			sideways(n.left, "", true)
+		}
+	}
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// Serialization: nodes are gob-encoded in pre-order, each with
+// flags telling whether it has a left and/or a right child. This
+// is enough to rebuild the exact same shape.
+const (
+	hasLeft = 1 << iota
+	hasRight
+)
+
+type entry[K cmp.Ordered, V any] struct {
+	Flags byte
+	Key   K
+	Value V
+}
+
+// AVL trees of that height would have more than 2⁶³ nodes
+const maxHeight = 92
+
+var errBadTree = errors.New("tree: decoded tree is not a valid AVL tree")
+
+// Encode serializes t; see Decode().
+func (t *Tree[K, V]) Encode(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+
+	// number of nodes, so that the empty tree can be
+	// told apart from a missing one.
+	if err := enc.Encode(t.Len()); err != nil {
+		return err
+	}
+
+	for n := range t.preOrderNodes() {
+		e := entry[K, V]{Key: n.key, Value: n.value}
+		if n.left != nil {
+			e.Flags |= hasLeft
+		}
+		if n.right != nil {
+			e.Flags |= hasRight
+		}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nodes of the tree, in pre-order
+func (t *Tree[K, V]) preOrderNodes() iter.Seq[*node[K, V]] {
+	return func(yield func(*node[K, V]) bool) {
+		var stack []*node[K, V]
+		if t.root != nil {
+			stack = append(stack, t.root)
+		}
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !yield(n) {
+				return
+			}
+			if n.right != nil {
+				stack = append(stack, n.right)
+			}
+			if n.left != nil {
+				stack = append(stack, n.left)
+			}
+		}
+	}
+}
+
+// Decode rebuilds a tree serialized by Encode(), with the exact
+// same shape. The decoded tree is checked to be a valid AVL
+// tree (ordering, balance).
+func Decode[K cmp.Ordered, V any](r io.Reader) (*Tree[K, V], error) {
+	dec := gob.NewDecoder(r)
+
+	var count int
+	if err := dec.Decode(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return &Tree[K, V]{}, nil
+	}
+
+	var decode func(depth int, lo, hi *K) (*node[K, V], error)
+	decode = func(depth int, lo, hi *K) (*node[K, V], error) {
+		if depth > maxHeight {
+			return nil, errBadTree
+		}
+
+		var e entry[K, V]
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if (lo != nil && cmp.Compare(e.Key, *lo) <= 0) || (hi != nil && cmp.Compare(e.Key, *hi) >= 0) {
+			return nil, errBadTree
+		}
+
+		n := &node[K, V]{key: e.Key, value: e.Value}
+		var err error
+		if e.Flags&hasLeft != 0 {
+			if n.left, err = decode(depth+1, lo, &n.key); err != nil {
+				return nil, err
+			}
+		}
+		if e.Flags&hasRight != 0 {
+			if n.right, err = decode(depth+1, &n.key, hi); err != nil {
+				return nil, err
+			}
+		}
+
+		n.fix()
+		if bf := height(n.left) - height(n.right); bf > 1 || bf < -1 {
+			return nil, errBadTree
+		}
+		return n, nil
+	}
+
+	root, err := decode(1, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if root.size != count {
+		return nil, errBadTree
+	}
+	return &Tree[K, V]{root}, nil
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"iter"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	// "fmt"
 )
@@ -14,3 +21,400 @@ func TestTreeString(t *testing.T) {
 		t.Errorf("Unexpected tree string: %s", p.String())
 	}
 }
+
+// Duplicates are kept, as in the original treesort.
+func TestTreeStringDuplicates(t *testing.T) {
+	p := addAll(nil, 3, 3, 1)
+	if p.String() != "1 3 3" {
+		t.Errorf("Unexpected tree string: %s", p.String())
+	}
+	if p.Len() != 2 {
+		t.Errorf("Unexpected number of keys: %d", p.Len())
+	}
+}
+
+// Checks the BST ordering, the AVL property and the stored
+// heights and sizes; returns the height of the subtree rooted at n.
+func checkNode[K cmp.Ordered, V any](t *testing.T, n *node[K, V], lo, hi *K) int {
+	if n == nil {
+		return 0
+	}
+	if (lo != nil && n.key <= *lo) || (hi != nil && n.key >= *hi) {
+		t.Fatalf("%v out of order", n.key)
+	}
+
+	l := checkNode(t, n.left, lo, &n.key)
+	r := checkNode(t, n.right, &n.key, hi)
+	if l-r > 1 || r-l > 1 {
+		t.Fatalf("%v: unbalanced (%d, %d)", n.key, l, r)
+	}
+	if n.height != 1+max(l, r) {
+		t.Fatalf("%v: height %d != %d", n.key, n.height, 1+max(l, r))
+	}
+	if n.size != 1+size(n.left)+size(n.right) {
+		t.Fatalf("%v: size %d != %d", n.key, n.size, 1+size(n.left)+size(n.right))
+	}
+	return n.height
+}
+
+func checkTree[K cmp.Ordered, V any](t *testing.T, p *Tree[K, V]) {
+	t.Helper()
+	checkNode(t, p.root, nil, nil)
+}
+
+func TestTreeSorted(t *testing.T) {
+	var p Tree[int, int]
+
+	for i := 0; i < 1<<12; i++ {
+		p.Put(i, i*i)
+	}
+	checkTree(t, &p)
+
+	// 1.44*log2(n) is the bound for AVL trees
+	if h := height(p.root); h > 18 {
+		t.Errorf("Tree too high: %d", h)
+	}
+
+	for i := 0; i < 1<<12; i += 2 {
+		p.Delete(i)
+	}
+	checkTree(t, &p)
+
+	if p.Len() != 1<<11 {
+		t.Errorf("Len() = %d ≠ %d", p.Len(), 1<<11)
+	}
+}
+
+func TestTreeRandom(t *testing.T) {
+	var p Tree[int, string]
+	ref := make(map[int]string)
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for i := 0; i < 5000; i++ {
+		k := r.IntN(500)
+		if r.IntN(3) == 0 {
+			_, ok := ref[k]
+			if p.Delete(k) != ok {
+				t.Fatalf("Delete(%d) != %v", k, ok)
+			}
+			delete(ref, k)
+		} else {
+			v := string(rune('a' + r.IntN(26)))
+			p.Put(k, v)
+			ref[k] = v
+		}
+	}
+	checkTree(t, &p)
+
+	if p.Len() != len(ref) {
+		t.Errorf("Len() = %d ≠ %d", p.Len(), len(ref))
+	}
+	for k := range 500 {
+		v, ok := p.Get(k)
+		w, ok2 := ref[k]
+		if v != w || ok != ok2 {
+			t.Errorf("Get(%d) = %s, %v ≠ %s, %v", k, v, ok, w, ok2)
+		}
+	}
+
+	var ks []int
+	for k, v := range p.All() {
+		if ref[k] != v {
+			t.Errorf("%d: %s ≠ %s", k, v, ref[k])
+		}
+		ks = append(ks, k)
+	}
+	if !slices.IsSorted(ks) || len(ks) != len(ref) {
+		t.Errorf("All() should iterate in order on all the keys")
+	}
+
+	var bs []int
+	for k := range p.Backward() {
+		bs = append(bs, k)
+	}
+	slices.Reverse(bs)
+	if !slices.Equal(ks, bs) {
+		t.Errorf("Backward() should iterate in reverse order")
+	}
+}
+
+func TestTreeMinMaxFloorCeiling(t *testing.T) {
+	var p Tree[int, bool]
+
+	if _, _, ok := p.Min(); ok {
+		t.Errorf("Empty tree has no min")
+	}
+	if _, _, ok := p.Floor(3); ok {
+		t.Errorf("Empty tree has no floor")
+	}
+
+	for _, k := range []int{10, 20, 30, 40, 50} {
+		p.Put(k, true)
+	}
+
+	if k, _, _ := p.Min(); k != 10 {
+		t.Errorf("Min() = %d ≠ 10", k)
+	}
+	if k, _, _ := p.Max(); k != 50 {
+		t.Errorf("Max() = %d ≠ 50", k)
+	}
+
+	for _, c := range []struct {
+		k, floor, ceil int
+		fok, cok       bool
+	}{
+		{5, 0, 10, false, true},
+		{10, 10, 10, true, true},
+		{25, 20, 30, true, true},
+		{50, 50, 50, true, true},
+		{55, 50, 0, true, false},
+	} {
+		if k, _, ok := p.Floor(c.k); k != c.floor || ok != c.fok {
+			t.Errorf("Floor(%d) = %d, %v", c.k, k, ok)
+		}
+		if k, _, ok := p.Ceiling(c.k); k != c.ceil || ok != c.cok {
+			t.Errorf("Ceiling(%d) = %d, %v", c.k, k, ok)
+		}
+	}
+}
+
+func TestTreeStringKeys(t *testing.T) {
+	var p Tree[string, int]
+	for _, k := range []string{"foo", "", "bar"} {
+		p.Put(k, 0)
+	}
+	if p.String() != " bar foo" {
+		t.Errorf("Unexpected tree string: '%s'", p.String())
+	}
+}
+
+func TestTreeOrderStatistics(t *testing.T) {
+	var p Tree[int, int]
+	r := rand.New(rand.NewPCG(3, 4))
+
+	for i := 0; i < 2000; i++ {
+		k := r.IntN(1000)
+		if r.IntN(4) == 0 {
+			p.Delete(k)
+		} else {
+			p.Put(k, -k)
+		}
+	}
+	checkTree(t, &p)
+
+	var ks []int
+	for k := range p.Keys() {
+		ks = append(ks, k)
+	}
+
+	for i, k := range ks {
+		if p.Rank(k) != i {
+			t.Fatalf("Rank(%d) = %d ≠ %d", k, p.Rank(k), i)
+		}
+		if x, v, ok := p.Select(i); x != k || v != -k || !ok {
+			t.Fatalf("Select(%d) = %d, %d, %v ≠ %d", i, x, v, ok, k)
+		}
+	}
+	if _, _, ok := p.Select(len(ks)); ok {
+		t.Errorf("Select(Len()) should have failed")
+	}
+	if _, _, ok := p.Select(-1); ok {
+		t.Errorf("Select(-1) should have failed")
+	}
+
+	for i := 0; i < 200; i++ {
+		lo, hi := r.IntN(1100)-50, r.IntN(1100)-50
+
+		var xs []int
+		for _, k := range ks {
+			if k >= lo && k < hi {
+				xs = append(xs, k)
+			}
+		}
+
+		if n := p.CountRange(lo, hi); n != len(xs) {
+			t.Fatalf("CountRange(%d, %d) = %d ≠ %d", lo, hi, n, len(xs))
+		}
+
+		var ys []int
+		for k, v := range p.Range(lo, hi) {
+			if v != -k {
+				t.Fatalf("%d: %d ≠ %d", k, v, -k)
+			}
+			ys = append(ys, k)
+		}
+		if !slices.Equal(xs, ys) {
+			t.Fatalf("Range(%d, %d) = %v ≠ %v", lo, hi, ys, xs)
+		}
+	}
+}
+
+func TestTreeRangeBreak(t *testing.T) {
+	var p Tree[int, struct{}]
+	for i := range 100 {
+		p.Put(i, struct{}{})
+	}
+
+	var ks []int
+	for k := range p.Range(10, 90) {
+		if k == 13 {
+			break
+		}
+		ks = append(ks, k)
+	}
+	if !slices.Equal(ks, []int{10, 11, 12}) {
+		t.Errorf("%v ≠ [10 11 12]", ks)
+	}
+}
+
+func keys[K any, V any](seq iter.Seq2[K, V]) []K {
+	var ks []K
+	for k := range seq {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+func TestTreeTraversals(t *testing.T) {
+	var p Tree[int, struct{}]
+	for i := 1; i <= 7; i++ {
+		p.Put(i, struct{}{})
+	}
+
+	if ks := keys(p.PreOrder()); !slices.Equal(ks, []int{4, 2, 1, 3, 6, 5, 7}) {
+		t.Errorf("PreOrder(): %v", ks)
+	}
+	if ks := keys(p.LevelOrder()); !slices.Equal(ks, []int{4, 2, 6, 1, 3, 5, 7}) {
+		t.Errorf("LevelOrder(): %v", ks)
+	}
+
+	var q Tree[int, struct{}]
+	if len(keys(q.PreOrder())) != 0 || len(keys(q.LevelOrder())) != 0 {
+		t.Errorf("Empty tree, empty traversals")
+	}
+}
+
+func TestTreeSideways(t *testing.T) {
+	var p Tree[int, struct{}]
+	for i := 1; i <= 5; i++ {
+		p.Put(i, struct{}{})
+	}
+
+	var b bytes.Buffer
+	if err := p.Sideways(&b); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	exp := strings.Join([]string{
+		"    /-- 5",
+		"/-- 4",
+		"|   \\-- 3",
+		"2",
+		"\\-- 1",
+		"",
+	}, "\n")
+	if b.String() != exp {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", b.String(), exp)
+	}
+}
+
+func TestTreeDot(t *testing.T) {
+	var p Tree[string, int]
+	p.Put("b", 0)
+	p.Put("a", 0)
+
+	var b bytes.Buffer
+	if err := p.Dot(&b); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	exp := `digraph tree {
+	node [shape=circle];
+	n0 [label="b"];
+	n1 [label="a"];
+	n0 -> n1;
+	n2 [shape=point];
+	n0 -> n2;
+}
+`
+	if b.String() != exp {
+		t.Errorf("Unexpected output:\n%s", b.String())
+	}
+}
+
+func TestTreeEncodeDecode(t *testing.T) {
+	var p Tree[int, string]
+	r := rand.New(rand.NewPCG(7, 8))
+	for i := 0; i < 1000; i++ {
+		if k := r.IntN(300); r.IntN(3) == 0 {
+			p.Delete(k)
+		} else {
+			p.Put(k, strconv.Itoa(i))
+		}
+	}
+
+	var b bytes.Buffer
+	if err := p.Encode(&b); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	q, err := Decode[int, string](&b)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	checkTree(t, q)
+
+	// pre-order + in-order determine the shape
+	if !slices.Equal(keys(p.PreOrder()), keys(q.PreOrder())) || p.String() != q.String() {
+		t.Errorf("Decoded tree has a different shape")
+	}
+	for k, v := range p.All() {
+		if w, _ := q.Get(k); v != w {
+			t.Errorf("%d: %s ≠ %s", k, w, v)
+		}
+	}
+
+	// empty tree
+	b.Reset()
+	(&Tree[int, string]{}).Encode(&b)
+	if q, err := Decode[int, string](&b); err != nil || q.Len() != 0 {
+		t.Errorf("Empty tree: %v, %v", q, err)
+	}
+}
+
+func TestTreeDecodeInvalid(t *testing.T) {
+	leaf := func(k int) *node[int, struct{}] {
+		return &node[int, struct{}]{key: k, height: 1, size: 1}
+	}
+
+	// unbalanced: 1 -> 2 -> 3
+	chain := leaf(1)
+	chain.right = leaf(2)
+	chain.right.right = leaf(3)
+	chain.right.fix()
+	chain.fix()
+
+	// unordered: 2 (3, 1)
+	unordered := leaf(2)
+	unordered.left, unordered.right = leaf(3), leaf(1)
+	unordered.fix()
+
+	for _, root := range []*node[int, struct{}]{chain, unordered} {
+		var b bytes.Buffer
+		(&Tree[int, struct{}]{root}).Encode(&b)
+		if _, err := Decode[int, struct{}](&b); err != errBadTree {
+			t.Errorf("Invalid tree should have been rejected, got %v", err)
+		}
+	}
+
+	// truncated
+	var p Tree[int, struct{}]
+	for i := range 10 {
+		p.Put(i, struct{}{})
+	}
+	var b bytes.Buffer
+	p.Encode(&b)
+	if _, err := Decode[int, struct{}](bytes.NewReader(b.Bytes()[:b.Len()-2])); err == nil {
+		t.Errorf("Truncated input should have failed")
+	}
+}
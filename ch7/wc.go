@@ -1,82 +1,265 @@
 package main
 
+// wc(1), as in GNU's coreutils (see the flags below), e.g.
+//
+//	go run wc.go segment.go counter.go -l -w wc.go tree.go
+//	go run wc.go segment.go counter.go -L < wc.go
+
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Let's allow potential word overlap between two consecutive
 // calls to Write, e.g.
 //	c.Write("hel"); c. Write("lo ") should count only one word, "hello".
+//
+// WordCounter, LineCounter and RuneCounter are state machines:
+// each byte is looked at once, and nothing is buffered but an
+// incomplete UTF-8 sequence, so memory use is constant, whatever
+// the length of the words/lines. Flush() counts what's been left
+// unterminated.
 type WordCounter struct {
-	n int
-	p []byte
+	n      int
+	inWord bool
+	d      runeDecoder
 }
 
 type LineCounter struct {
+	n      int
+	inLine bool // bytes written since the last '\n'
+}
+
+// UTF-8 encoded runes; a sequence split between two calls
+// to Write is counted once. An invalid byte counts as one
+// rune (utf8.RuneError).
+type RuneCounter struct {
 	n int
-	p []byte
+	d runeDecoder
 }
 
-// « The Go compiler does not support accessing a struct field
-// x.f where x is of type parameter type even if all types in
-// the type parameter's type set have a field f. We may remove
-// this restriction in a future release. »
-//
-// Generics aren't covered by gopl anyway; this also means
-// we can't use a generic doWrite that access our Counter's fields.
-func (c *WordCounter) Incr() { c.n += 1 }
-func (c *LineCounter) Incr() { c.n += 1 }
-
-func (c *WordCounter) Save(p []byte) { c.p = p }
-func (c *LineCounter) Save(p []byte) { c.p = p }
-
-func (c *WordCounter) GetSave() []byte { return c.p }
-func (c *LineCounter) GetSave() []byte { return c.p }
-
-type Counter interface {
-	Incr()
-	Save(p []byte)
-	GetSave() []byte
-}
-
-// Perhaps there's a more efficient approach, but this seems to work.
-func doWrite(c Counter, p []byte, f bufio.SplitFunc) (int, error) {
-	// Grab what remained last time.
-	q := append(c.GetSave(), p...)
-
-	m := 0
-	for {
-		n, ts, err := f(q[m:], false)
-//		fmt.Printf("n=%d; ts=%s; err=%v\n", n, string(ts), err)
-		if n == 0 {
-			break
-		}
-		if err != nil {
-			return m, err
-		}
-		m += n
+// Incremental UTF-8 decoding: an incomplete sequence is
+// kept until the next Write.
+type runeDecoder struct {
+	p [utf8.UTFMax]byte
+	n int
+}
 
-		// we may be advancing further, but still not reaching
-		// a word (spaces)
-		if len(ts) > 0 {
-			c.Incr()
+// Feeds b to d, calling f on each rune it completes; as for
+// utf8.DecodeRune, an invalid byte is decoded as utf8.RuneError.
+func (d *runeDecoder) push(b byte, f func(r rune, size int)) {
+	d.p[d.n] = b
+	d.n++
+	for d.n > 0 && utf8.FullRune(d.p[:d.n]) {
+		r, n := utf8.DecodeRune(d.p[:d.n])
+		f(r, n)
+		d.n = copy(d.p[:], d.p[n:d.n])
+	}
+}
+
+// What remains is an incomplete sequence, i.e. invalid bytes.
+func (d *runeDecoder) flush(f func(r rune, size int)) {
+	for ; d.n > 0; d.n-- {
+		f(utf8.RuneError, 1)
+	}
+}
+
+// Same as bufio.ScanWords' (unexported) isSpace().
+func isSpace(r rune) bool {
+	if r <= '\u00FF' {
+		switch r {
+		case ' ', '\t', '\n', '\v', '\f', '\r', '\u0085', '\u00A0':
+			return true
 		}
+		return false
+	}
+	if '\u2000' <= r && r <= '\u200a' {
+		return true
+	}
+	switch r {
+	case '\u1680', '\u2028', '\u2029', '\u202f', '\u205f', '\u3000':
+		return true
+	}
+	return false
+}
+
+func (c *WordCounter) step(r rune) {
+	switch {
+	case !isSpace(r):
+		c.inWord = true
+	case c.inWord:
+		c.n++
+		c.inWord = false
 	}
-	c.Save(q[m:])
-//	println("Saving for later: '"+string(c.GetSave())+"'")
-	return m, nil
 }
 
 func (c *WordCounter) Write(p []byte) (int, error) {
-	return doWrite(c, p, bufio.ScanWords)
+	for _, b := range p {
+		// ASCII fast path
+		if b < utf8.RuneSelf && c.d.n == 0 {
+			c.step(rune(b))
+			continue
+		}
+		c.d.push(b, func(r rune, _ int) { c.step(r) })
+	}
+	return len(p), nil
+}
+
+// Flush counts a last word, not followed by a space.
+func (c *WordCounter) Flush() {
+	c.d.flush(func(r rune, _ int) { c.step(r) })
+	c.step(' ')
+}
+
+func (c *WordCounter) Count() int64 { return int64(c.n) }
+
+func (c *WordCounter) Close() error {
+	c.Flush()
+	return nil
 }
 
 func (c *LineCounter) Write(p []byte) (int, error) {
-	return doWrite(c, p, bufio.ScanLines)
+	if len(p) > 0 {
+		c.n += bytes.Count(p, []byte{'\n'})
+		c.inLine = p[len(p)-1] != '\n'
+	}
+	return len(p), nil
 }
 
+// Flush counts a last line, not terminated by a '\n'.
+//
+// NOTE: wc -l counts newlines, and thus doesn't flush.
+func (c *LineCounter) Flush() {
+	if c.inLine {
+		c.n++
+		c.inLine = false
+	}
+}
+
+func (c *LineCounter) Count() int64 { return int64(c.n) }
+
+func (c *LineCounter) Close() error {
+	c.Flush()
+	return nil
+}
+
+func (c *RuneCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b < utf8.RuneSelf && c.d.n == 0 {
+			c.n++
+			continue
+		}
+		c.d.push(b, func(rune, int) { c.n++ })
+	}
+	return len(p), nil
+}
+
+// Flush counts the bytes of a last incomplete sequence, as
+// invalid runes.
+func (c *RuneCounter) Flush() {
+	c.d.flush(func(rune, int) { c.n++ })
+}
+
+func (c *RuneCounter) Count() int64 { return int64(c.n) }
+
+func (c *RuneCounter) Close() error {
+	c.Flush()
+	return nil
+}
+
+// Unicode-aware counters (see segment.go); in particular,
+// UnicodeWordCounter gives meaningful results for CJK text,
+// where words aren't separated by spaces.
+type GraphemeCounter = SplitCounter[graphemes]
+type UnicodeWordCounter = SplitCounter[unicodeWords]
+type SentenceCounter = SplitCounter[sentences]
+
+type graphemes struct{}
+type unicodeWords struct{}
+type sentences struct{}
+
+func (graphemes) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return ScanGraphemes(data, atEOF)
+}
+
+func (unicodeWords) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return ScanUnicodeWords(data, atEOF)
+}
+
+func (sentences) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return ScanSentences(data, atEOF)
+}
+
+// Length of the longest line, in columns, as GNU's wc -L: tab
+// stops are every 8 columns, wide (e.g. CJK) characters take two
+// columns, non-printable ones none. The last line needs not be
+// terminated.
+type MaxLineLength struct {
+	n   int
+	cur int
+	d   runeDecoder
+}
+
+// Wide characters, roughly; see Unicode's East Asian Width (UAX #11).
+var wide = []*unicode.RangeTable{
+	unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana,
+	{R16: []unicode.Range16{
+		{Lo: 0xff01, Hi: 0xff60, Stride: 1}, // fullwidth forms
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	}},
+}
+
+func (c *MaxLineLength) step(r rune, size int) {
+	switch {
+	case r == '\n' || r == '\r' || r == '\f':
+		c.cur = 0
+	case r == '\t':
+		c.cur += 8 - c.cur%8
+	case r == utf8.RuneError && size == 1:
+		// invalid byte
+	case unicode.Is(unicode.Mn, r) || !unicode.IsPrint(r):
+	case unicode.In(r, wide...):
+		c.cur += 2
+	default:
+		c.cur++
+	}
+	c.n = max(c.n, c.cur)
+}
+
+// Count is the length of the longest line so far.
+func (c *MaxLineLength) Count() int64 { return int64(c.n) }
+
+func (c *MaxLineLength) Write(p []byte) (int, error) {
+	for _, b := range p {
+		// printable ASCII, by far the most common
+		if ' ' <= b && b <= '~' && c.d.n == 0 {
+			c.cur++
+			c.n = max(c.n, c.cur)
+			continue
+		}
+		c.d.push(b, c.step)
+	}
+	return len(p), nil
+}
+
+// Bytes written to w, which can be read from other goroutines
+// while writes continue, e.g. for a download meter:
+//
+//	cw, _ := CountingWriter(f)
+//	stop := Progress(cw.(Counter), time.Second, func(n int64) {
+//		fmt.Fprintf(os.Stderr, "\r%d bytes", n)
+//	})
+//	io.Copy(cw, resp.Body)
+//	stop()
 type ByteCounterWrapper struct {
 	w io.Writer
 	n int64
@@ -84,23 +267,212 @@ type ByteCounterWrapper struct {
 
 func (cw *ByteCounterWrapper) Write(p []byte) (int, error) {
 	n, err := cw.w.Write(p)
-	cw.n += int64(n)
+	atomic.AddInt64(&cw.n, int64(n))
 	return n, err
 }
 
+func (cw *ByteCounterWrapper) Count() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
+
+// NOTE: *int64 must be read with atomic.LoadInt64() while
+// writes continue.
 func CountingWriter(w io.Writer) (io.Writer, *int64) {
 	cw := &ByteCounterWrapper{w, 0}
 	return cw, &cw.n
 }
 
+var (
+	showLines   = flag.Bool("l", false, "print the newline counts")
+	showWords   = flag.Bool("w", false, "print the word counts")
+	showBytes   = flag.Bool("c", false, "print the byte counts")
+	showChars   = flag.Bool("m", false, "print the character counts")
+	showLongest = flag.Bool("L", false, "print the maximum display width")
+)
+
+type counts struct {
+	lines, words, chars, bytes, longest int64
+}
+
+func (c *counts) add(d counts) {
+	c.lines += d.lines
+	c.words += d.words
+	c.chars += d.chars
+	c.bytes += d.bytes
+	c.longest = max(c.longest, d.longest)
+}
+
+// Streams r through all the (selected) counters at once, with a
+// single io.MultiWriter (no need for MultiCounter here: counts are
+// only read once the copy is over).
+func count(r io.Reader) (counts, error) {
+	var ws []io.Writer
+
+	lc := &LineCounter{}
+	wc := &WordCounter{}
+	rc := &RuneCounter{}
+	ml := &MaxLineLength{}
+	bc := &ByteCounterWrapper{io.Discard, 0}
+
+	if *showLines {
+		ws = append(ws, lc)
+	}
+	if *showWords {
+		ws = append(ws, wc)
+	}
+	if *showChars {
+		ws = append(ws, rc)
+	}
+	if *showLongest {
+		ws = append(ws, ml)
+	}
+	// always cheap
+	ws = append(ws, bc)
+
+	_, err := io.Copy(io.MultiWriter(ws...), r)
+
+	// NOTE: wc -l counts newlines, so a last unterminated line
+	// isn't counted; an incomplete UTF-8 sequence isn't a rune.
+	wc.Flush()
+
+	return counts{
+		lc.Count(), wc.Count(), rc.Count(), bc.Count(), ml.Count(),
+	}, err
+}
+
+// As GNU's: wide enough for the total size of the (regular)
+// files, or 7 if some of them aren't regular (e.g. stdin
+// is a pipe); no padding for a single count of a single file.
+func numberWidth(fis []os.FileInfo, ncounts int) int {
+	if len(fis) == 1 && ncounts == 1 {
+		return 1
+	}
+	if len(fis) == 0 || fis[0] == nil {
+		return 1
+	}
+
+	width, minWidth := 1, 1
+	var total int64
+	for _, fi := range fis {
+		if fi == nil {
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			minWidth = 7
+		} else {
+			total += fi.Size()
+		}
+	}
+	for ; total >= 10; total /= 10 {
+		width++
+	}
+	return max(width, minWidth)
+}
+
+func printCounts(w io.Writer, c counts, width int, name string) {
+	sep := ""
+	for _, x := range []struct {
+		selected bool
+		n        int64
+	}{
+		{*showLines, c.lines},
+		{*showWords, c.words},
+		{*showChars, c.chars},
+		{*showBytes, c.bytes},
+		{*showLongest, c.longest},
+	} {
+		if x.selected {
+			fmt.Fprintf(w, "%s%*d", sep, width, x.n)
+			sep = " "
+		}
+	}
+	if name != "" {
+		fmt.Fprintf(w, " %s", name)
+	}
+	fmt.Fprintln(w)
+}
+
+// GNU-style error message, e.g. "foo: No such file or directory"
+func errorf(name string, err error) string {
+	if name == "" {
+		name = "standard input"
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	msg := []rune(err.Error())
+	msg[0] = unicode.ToUpper(msg[0])
+	return name + ": " + string(msg)
+}
+
 func main() {
+	flag.Parse()
+
+	if !*showLines && !*showWords && !*showChars && !*showBytes && !*showLongest {
+		*showLines, *showWords, *showBytes = true, true, true
+	}
+	ncounts := 0
+	for _, b := range []bool{*showLines, *showWords, *showChars, *showBytes, *showLongest} {
+		if b {
+			ncounts++
+		}
+	}
+
+	// "" is stdin, unnamed
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{""}
+	}
 
-	c, n := CountingWriter(&WordCounter{0,make([]byte,0)})
+	// Open everything first, to compute the columns' width;
+	// errors are reported in order though.
+	fds := make([]*os.File, len(names))
+	fis := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+	for i, name := range names {
+		fd := os.Stdin
+		if name != "" && name != "-" {
+			if fd, errs[i] = os.Open(name); errs[i] != nil {
+				continue
+			}
+		}
+		if fis[i], errs[i] = fd.Stat(); errs[i] != nil {
+			fd.Close()
+			continue
+		}
+		fds[i] = fd
+	}
 
-	c.Write([]byte("hello, world"))
+	width := numberWidth(fis, ncounts)
+	out := bufio.NewWriter(os.Stdout)
+	status := 0
 
-	fmt.Printf("Counter: %d\n", *n)
-	c.Write([]byte(" "))
-	fmt.Printf("Counter: %d\n", *n)
+	var total counts
+	for i, fd := range fds {
+		if fd == nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "wc: %s\n", errorf(names[i], errs[i]))
+			status = 1
+			continue
+		}
+		c, err := count(fd)
+		if fd != os.Stdin {
+			fd.Close()
+		}
+		if err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "wc: %s\n", errorf(names[i], err))
+			status = 1
+		}
+		printCounts(out, c, width, names[i])
+		total.add(c)
+	}
+
+	if len(names) > 1 {
+		printCounts(out, total, width, "total")
+	}
 
+	out.Flush()
+	os.Exit(status)
 }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"strings"
 	"testing"
 	"fmt"
+	"io"
+	"math/rand/v2"
 )
 
 func TestWordCounter(t *testing.T) {
 
-	c := &WordCounter{0,make([]byte,0)}
+	c := &WordCounter{}
 
 	c.Write([]byte("hello, world"))
 
@@ -45,7 +50,7 @@ func TestWordCounter(t *testing.T) {
 
 func TestLineCounter(t *testing.T) {
 
-	c := &LineCounter{0,make([]byte,0)}
+	c := &LineCounter{}
 
 	c.Write([]byte("hello, world"))
 
@@ -81,14 +86,16 @@ func TestLineCounter(t *testing.T) {
 }
 
 func TestCountingWriter(t *testing.T) {
-	c, n := CountingWriter(&WordCounter{0,make([]byte,0)})
+	c, n := CountingWriter(&WordCounter{})
 
 	// Haven't tested this before here actually (used as an io.Writer)
 	fmt.Fprintf(c, "hello, world")
 
-	if *n != int64(len("hello, ")) {
-		t.Errorf("We should have counted %d bytes (`hello, `); have %d",
-			len("hello "), *n)
+	// What isn't consumed yet ("world") is saved by the
+	// WordCounter, but still reported as written.
+	if *n != int64(len("hello, world")) {
+		t.Errorf("We should have counted %d bytes (`hello, world`); have %d",
+			len("hello, world"), *n)
 	}
 
 	c.Write([]byte(" "))
@@ -98,3 +105,219 @@ func TestCountingWriter(t *testing.T) {
 			len("hello, world "), *n)
 	}
 }
+
+func TestLineCounterEmptyLines(t *testing.T) {
+	c := &LineCounter{}
+
+	c.Write([]byte("a\n\nb\n"))
+
+	if c.n != 3 {
+		t.Errorf("Empty lines are lines too; got %d", c.n)
+	}
+}
+
+func TestRuneCounter(t *testing.T) {
+	c := &RuneCounter{}
+
+	// "é" is 0xc3 0xa9
+	c.Write([]byte("h\xc3"))
+
+	if c.n != 1 {
+		t.Errorf("Incomplete sequence shouldn't have been counted yet")
+	}
+
+	c.Write([]byte("\xa9llo, 世界"))
+
+	if c.n != 9 {
+		t.Errorf("Expected 9 runes, got %d", c.n)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	c := &MaxLineLength{}
+
+	c.Write([]byte("abc\n"))
+	c.Write([]byte("\tx\n世"))
+
+	// tab stops every 8 columns
+	if c.n != 9 {
+		t.Errorf("Expected 9 columns, got %d", c.n)
+	}
+
+	// unterminated, split UTF-8 sequence; wide chars
+	c.Write([]byte("界界界\xe7"))
+	c.Write([]byte("\x95\x8c"))
+
+	if c.n != 10 {
+		t.Errorf("Expected 10 columns, got %d", c.n)
+	}
+}
+
+// Sets the flags, restored once t is over.
+func setFlags(t *testing.T, l, w, m, c, L bool) {
+	ps := []*bool{showLines, showWords, showChars, showBytes, showLongest}
+	old := make([]bool, len(ps))
+	for i, p := range ps {
+		old[i] = *p
+	}
+	t.Cleanup(func() {
+		for i, p := range ps {
+			*p = old[i]
+		}
+	})
+	*showLines, *showWords, *showChars, *showBytes, *showLongest = l, w, m, c, L
+}
+
+func TestCount(t *testing.T) {
+	setFlags(t, true, true, true, true, true)
+
+	c, err := count(strings.NewReader("héllo, world\n\n  last"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// the last line isn't terminated, but the last word is a word
+	exp := counts{lines: 2, words: 3, chars: 20, bytes: 21, longest: 12}
+	if c != exp {
+		t.Errorf("%+v != %+v", c, exp)
+	}
+
+	var b bytes.Buffer
+	setFlags(t, true, true, false, true, false)
+	printCounts(&b, c, 3, "foo")
+	if b.String() != "  2   3  21 foo\n" {
+		t.Errorf("Unexpected output: '%s'", b.String())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	w := &WordCounter{}
+	l := &LineCounter{}
+	r := &RuneCounter{}
+
+	for _, c := range []io.Writer{w, l, r} {
+		fmt.Fprintf(c, "hello\nworld\xe4\xb8")
+	}
+
+	if w.n != 1 || l.n != 1 || r.n != 11 {
+		t.Errorf("Unexpected counts before flush: %d, %d, %d", w.n, l.n, r.n)
+	}
+
+	w.Close()
+	l.Close()
+	r.Close()
+
+	// the incomplete sequence is made of two invalid bytes
+	if w.n != 2 || l.n != 2 || r.n != 13 {
+		t.Errorf("Unexpected counts after flush: %d, %d, %d", w.n, l.n, r.n)
+	}
+
+	// nothing more to flush
+	w.Flush()
+	l.Flush()
+	r.Flush()
+	if w.n != 2 || l.n != 2 || r.n != 13 {
+		t.Errorf("Flush() should be idempotent: %d, %d, %d", w.n, l.n, r.n)
+	}
+}
+
+// The state machines should agree with bufio.Scanner, however
+// the input is split.
+func TestCountersVsScanner(t *testing.T) {
+	alphabet := []string{
+		"a", "b", " ", "\t", "\n", " ", "　", "é", "世",
+		"\xff", "\xe4", "\xb8", " ",
+	}
+	scan := func(s string, f bufio.SplitFunc) int {
+		n := 0
+		sc := bufio.NewScanner(strings.NewReader(s))
+		sc.Split(f)
+		for sc.Scan() {
+			n++
+		}
+		return n
+	}
+
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 500; i++ {
+		var sb strings.Builder
+		for j := rnd.IntN(50); j > 0; j-- {
+			sb.WriteString(alphabet[rnd.IntN(len(alphabet))])
+		}
+		s := sb.String()
+
+		w := &WordCounter{}
+		l := &LineCounter{}
+		r := &RuneCounter{}
+		for p := s; len(p) > 0; {
+			k := 1 + rnd.IntN(len(p))
+			for _, c := range []io.Writer{w, l, r} {
+				c.Write([]byte(p[:k]))
+			}
+			p = p[k:]
+		}
+		w.Flush()
+		l.Flush()
+		r.Flush()
+
+		if exp := scan(s, bufio.ScanWords); w.n != exp {
+			t.Errorf("%q: %d words, expected %d", s, w.n, exp)
+		}
+		if exp := scan(s, bufio.ScanLines); l.n != exp {
+			t.Errorf("%q: %d lines, expected %d", s, l.n, exp)
+		}
+		if exp := scan(s, bufio.ScanRunes); r.n != exp {
+			t.Errorf("%q: %d runes, expected %d", s, r.n, exp)
+		}
+	}
+}
+
+// Nothing is buffered, even without any newline.
+func TestConstantMemory(t *testing.T) {
+	p := bytes.Repeat([]byte("héllo"), 1024)
+	p = append(p, "\xe4"...) // split sequence
+
+	w := &WordCounter{}
+	l := &LineCounter{}
+	r := &RuneCounter{}
+	m := &MaxLineLength{}
+
+	for _, c := range []io.Writer{w, l, r, m} {
+		if n := testing.AllocsPerRun(100, func() { c.Write(p) }); n != 0 {
+			t.Errorf("%T: %.0f allocations per Write", c, n)
+		}
+	}
+}
+
+// 1 GB of text, in 64 KB chunks, e.g.
+//
+//	go test -bench . -benchtime 1x wc.go segment.go counter.go wc_test.go
+func benchmarkGB(b *testing.B, c io.Writer) {
+	chunk := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dög.\n"), 1<<16/46)
+	total := 1 << 30
+
+	b.SetBytes(int64(total))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := 0; n < total; n += len(chunk) {
+			c.Write(chunk)
+		}
+	}
+}
+
+func BenchmarkWordCounter(b *testing.B) {
+	benchmarkGB(b, &WordCounter{})
+}
+
+func BenchmarkLineCounter(b *testing.B) {
+	benchmarkGB(b, &LineCounter{})
+}
+
+func BenchmarkRuneCounter(b *testing.B) {
+	benchmarkGB(b, &RuneCounter{})
+}
+
+func BenchmarkMaxLineLength(b *testing.B) {
+	benchmarkGB(b, &MaxLineLength{})
+}
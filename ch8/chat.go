@@ -6,16 +6,30 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"time"
+	"unicode"
 )
 
 type client struct {
 	ch     chan<- string
-	name   string
+	name   string // owned by the broadcaster, once entered
 	ticker *time.Ticker
+	room   *room // likewise; nil if none
 }
 
+// Messages only reach the members of the sender's room. Rooms are
+// created when first joined, and removed once empty.
+type room struct {
+	name    string // e.g. "#go"
+	topic   string
+	members map[*client]bool
+}
+
+// Where clients are, when entering.
+const lobby = "#lobby"
+
 var port = flag.String("p", ":8000", "listening port")
 
 // automatically disconnect clients after that much time of idling.
@@ -24,63 +38,283 @@ var (
 	msgTimeout = 500 * time.Millisecond
 )
 
+// A client asking to enter, as name; the broadcaster tells
+// whether the name is available.
+type entry struct {
+	cli  *client
+	name string
+	ok   chan<- bool
+}
+
+// A line sent by an entered client: a message (cmd is empty),
+// or a command, as in "/msg bob hi" (cmd "msg", arg "bob hi").
+type command struct {
+	from *client
+	cmd  string
+	arg  string
+}
+
 var (
-	entering = make(chan client)
-	leaving  = make(chan client)
-	messages = make(chan string)
+	entering = make(chan entry)
+	leaving  = make(chan *client)
+	commands = make(chan command)
 	timeouts = make(chan net.Conn) // 8.13
 )
 
-// 8.12
-func lsClients(to client, clients map[client]bool) {
-	names := make([]string, len(clients))
-	i := 0
-	for cli := range clients {
-		names[i] = cli.name
-		i++
+const help = `Commands:
+  /msg <nick> <text>  private message
+  /nick <nick>        change your name
+  /who                list users (of your room)
+  /me <text>          action, e.g. "/me waves"
+  /join #<room>       move to a room, created if needed
+  /part               leave your room
+  /list               list rooms, with their member counts
+  /topic [<text>]     show, or set, your room's topic
+  /quit               leave
+  /help               this help`
+
+// The broadcaster's state.
+type chat struct {
+	clients map[string]*client // by name
+	rooms   map[string]*room   // by name
+
+	// never stopped, but lifelong.
+	ticker *time.Ticker
+}
+
+// Names are single words.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, unicode.IsSpace)
+}
+
+// Room names are names starting with a "#".
+func validRoom(name string) bool {
+	return len(name) > 1 && name[0] == '#' && validName(name)
+}
+
+// Sends msg to cli, unless it's too slow to take it.
+func (c *chat) send(cli *client, msg string) {
+	c.ticker.Reset(msgTimeout)
+
+	// wait a little before giving up on sending
+	// this message to current client
+	//
+	// alternative solution is probably to use
+	// a ch := make(chan string, 5) in handleConn()
+	// so that we have room to buffer messages, and
+	// then here to
+	//
+	//	select {
+	//	case cli.ch <-msg:
+	//	default:
+	//	}
+	//
+	// aka, non-blocking send (if write unavailable,
+	// default is executed)
+	select {
+	case cli.ch <- msg:
+	case <-c.ticker.C:
 	}
-	to.ch <- "Users: " + strings.Join(names, ", ")
 }
 
-func broadcaster() {
-	clients := make(map[client]bool)
+// Sends msg to the members of r.
+func (c *chat) broadcast(r *room, msg string) {
+	for cli := range r.members {
+		c.send(cli, msg)
+	}
+}
 
-	// never stopped, but lifelong goroutine.
-	ticker := time.NewTicker(msgTimeout)
+// Sends msg to the members of cli's room, or to cli only, if
+// it's in none.
+func (c *chat) announce(cli *client, msg string) {
+	if cli.room != nil {
+		c.broadcast(cli.room, msg)
+	} else {
+		c.send(cli, msg)
+	}
+}
 
-	for {
-		select {
-		case msg := <-messages:
-			for cli := range clients {
-				ticker.Reset(msgTimeout)
-
-				// wait a little before giving up on sending
-				// this message to current client
-				//
-				// alternative solution is probably to use
-				// a ch := make(chan string, 5) in handleConn()
-				// so that we have room to buffer messages, and
-				// then here to
-				//
-				//	select {
-				//	case cli.ch <-msg:
-				//	default:
-				//	}
-				//
-				// aka, non-blocking send (if write unavailable,
-				// default is executed)
-				select {
-				case cli.ch <- msg:
-				case <-ticker.C:
-				}
+// 8.12; the members of to's room, or everyone if it's in none.
+func (c *chat) lsClients(to *client) {
+	var names []string
+	if to.room != nil {
+		for cli := range to.room.members {
+			names = append(names, cli.name)
+		}
+	} else {
+		for name := range c.clients {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if to.room != nil {
+		c.send(to, "Users on "+to.room.name+": "+strings.Join(names, ", "))
+	} else {
+		c.send(to, "Users: "+strings.Join(names, ", "))
+	}
+}
 
+func (c *chat) lsRooms(to *client) {
+	rooms := make([]string, 0, len(c.rooms))
+	for _, r := range c.rooms {
+		rooms = append(rooms, fmt.Sprintf("%s (%d)", r.name, len(r.members)))
+	}
+	sort.Strings(rooms)
+	c.send(to, "Rooms: "+strings.Join(rooms, ", "))
+}
+
+// Moves cli to the room name, created if needed; msg is
+// announced there, to cli included.
+func (c *chat) join(cli *client, name, msg string) {
+	if cli.room != nil {
+		c.part(cli, cli.name+" has left "+cli.room.name)
+	}
+
+	r := c.rooms[name]
+	if r == nil {
+		r = &room{name: name, members: make(map[*client]bool)}
+		c.rooms[name] = r
+	}
+	r.members[cli] = true
+	cli.room = r
+	c.broadcast(r, msg)
+}
+
+// Removes cli from its room, if any, which is removed once
+// empty; msg is announced there, to cli included.
+func (c *chat) part(cli *client, msg string) {
+	r := cli.room
+	if r == nil {
+		return
+	}
+	c.broadcast(r, msg)
+	delete(r.members, cli)
+	cli.room = nil
+	if len(r.members) == 0 {
+		delete(c.rooms, r.name)
+	}
+}
+
+func (c *chat) enter(e entry) {
+	if !validName(e.name) || c.clients[e.name] != nil {
+		e.ok <- false
+		return
+	}
+	e.ok <- true
+
+	e.cli.name = e.name
+	c.clients[e.name] = e.cli
+	c.send(e.cli, "Connected as "+e.name)
+	c.join(e.cli, lobby, e.name+" has entered the chat")
+	c.lsClients(e.cli)
+}
+
+func (c *chat) leave(cli *client) {
+	c.part(cli, cli.name+" has left the chat")
+	delete(c.clients, cli.name)
+	close(cli.ch)
+}
+
+func (c *chat) command(cmd command) {
+	from := cmd.from
+	switch cmd.cmd {
+	case "", "me":
+		if from.room == nil {
+			c.send(from, "error: not on any room (see /join)")
+			return
+		}
+		msg := from.name + ": " + cmd.arg
+		if cmd.cmd == "me" {
+			msg = "* " + from.name + " " + cmd.arg
+		}
+		c.broadcast(from.room, msg)
+	case "msg":
+		name, text, _ := strings.Cut(cmd.arg, " ")
+		to := c.clients[name]
+		switch {
+		case name == "" || text == "":
+			c.send(from, "error: usage: /msg <nick> <text>")
+		case to == nil:
+			c.send(from, "error: no such user: "+name)
+		default:
+			c.send(to, from.name+" (private): "+text)
+			if to != from {
+				c.send(from, "-> "+name+": "+text)
+			}
+		}
+	case "nick":
+		name := cmd.arg
+		switch {
+		case !validName(name):
+			c.send(from, "error: usage: /nick <nick>")
+		case name == from.name:
+		case c.clients[name] != nil:
+			c.send(from, "error: name already taken: "+name)
+		default:
+			delete(c.clients, from.name)
+			c.announce(from, from.name+" is now known as "+name)
+			from.name = name
+			c.clients[name] = from
+		}
+	case "who":
+		c.lsClients(from)
+	case "join":
+		name := cmd.arg
+		switch {
+		case !validRoom(name):
+			c.send(from, "error: usage: /join #<room>")
+		case from.room != nil && from.room.name == name:
+			c.send(from, "error: already on "+name)
+		default:
+			c.join(from, name, from.name+" has joined "+name)
+			if t := from.room.topic; t != "" {
+				c.send(from, "Topic for "+name+": "+t)
 			}
-		case cli := <-entering:
-			clients[cli] = true
-			lsClients(cli, clients)
+		}
+	case "part":
+		if from.room == nil {
+			c.send(from, "error: not on any room")
+			return
+		}
+		c.part(from, from.name+" has left "+from.room.name)
+	case "list":
+		c.lsRooms(from)
+	case "topic":
+		r := from.room
+		switch {
+		case r == nil:
+			c.send(from, "error: not on any room")
+		case cmd.arg != "":
+			r.topic = cmd.arg
+			c.broadcast(r, from.name+" set the topic of "+r.name+": "+r.topic)
+		case r.topic == "":
+			c.send(from, "No topic for "+r.name)
+		default:
+			c.send(from, "Topic for "+r.name+": "+r.topic)
+		}
+	case "help":
+		c.send(from, help)
+	default:
+		c.send(from, "error: unknown command /"+cmd.cmd+" (see /help)")
+	}
+}
+
+func broadcaster() {
+	c := chat{
+		clients: make(map[string]*client),
+		rooms:   make(map[string]*room),
+		ticker:  time.NewTicker(msgTimeout),
+	}
+
+	for {
+		select {
+		case cmd := <-commands:
+			c.command(cmd)
+		case e := <-entering:
+			c.enter(e)
 		case cli := <-leaving:
-			delete(clients, cli)
-			close(cli.ch)
+			c.leave(cli)
 		}
 	}
 }
@@ -93,22 +327,35 @@ func timeouter() {
 	}
 }
 
-func clientWriter(conn net.Conn, ch chan string) {
+func clientWriter(conn net.Conn, ch chan string, done chan<- struct{}) {
 	for msg := range ch {
 		fmt.Fprintln(conn, msg)
 	}
+	close(done)
+}
+
+// Splits a line into a command and its argument, e.g.
+// "/msg bob hi" is "msg", "bob hi"; a message has no
+// command ("//..." being a message starting with a "/").
+func parseLine(line string) (cmd, arg string) {
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		return "", strings.TrimPrefix(line, "/")
+	}
+	cmd, arg, _ = strings.Cut(line[1:], " ")
+	return cmd, strings.TrimSpace(arg)
 }
 
 func handleConn(conn net.Conn) {
 	ch := make(chan string)
+	done := make(chan struct{})
 
 	// Set a temporary name & a corresponding client:
 	// we want the timeout goroutine below to be running
 	// even when user hasn't provided a name yet.
-	cli := client{
-		ch,
-		conn.RemoteAddr().String(),
-		time.NewTicker(timeout),
+	cli := &client{
+		ch:     ch,
+		name:   conn.RemoteAddr().String(),
+		ticker: time.NewTicker(timeout),
 	}
 
 	// 8.13
@@ -125,32 +372,42 @@ func handleConn(conn net.Conn) {
 		cli.ticker.Stop()
 	}()
 
-	// XXX we allow the same name to be used by different clients.
-	input := bufio.NewScanner(conn)
-	fmt.Fprintf(conn, "Enter your name: ")
-	ok := input.Scan()
-	if !ok {
-		conn.Close()
-		return
-	}
-	cli.ticker.Reset(timeout)
-	cli.name = input.Text()
+	// nothing is sent to ch until we've entered
+	go clientWriter(conn, ch, done)
 
-	go clientWriter(conn, ch)
+	// names are unique: ask until we get an available one
+	input := bufio.NewScanner(conn)
+	for {
+		fmt.Fprintf(conn, "Enter your name: ")
+		if !input.Scan() {
+			close(ch)
+			conn.Close()
+			return
+		}
+		cli.ticker.Reset(timeout)
 
-	ch <- "Connected as " + cli.name
-	messages <- cli.name + " has entered the chat"
-	entering <- cli
+		ok := make(chan bool)
+		name := strings.TrimSpace(input.Text())
+		entering <- entry{cli, name, ok}
+		if <-ok {
+			break
+		}
+		fmt.Fprintf(conn, "Name %q is invalid, or already taken\n", name)
+	}
 
 	for input.Scan() {
-		messages <- cli.name + ": " + input.Text()
 		cli.ticker.Reset(timeout) // 8.13
+		cmd, arg := parseLine(input.Text())
+		if cmd == "quit" {
+			break
+		}
+		commands <- command{cli, cmd, arg}
 	}
 
 	leaving <- cli
-	messages <- cli.name + " has left the chat"
 
-	// Already closed on timeout
+	// let the last messages through; already closed on timeout
+	<-done
 	conn.Close()
 }
 
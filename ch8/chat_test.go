@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Address of the chat server, shared by all the tests (there's a
+// single broadcaster): names must differ from one test to another.
+var chatAddr string
+
+func TestMain(m *testing.M) {
+	timeout = time.Minute
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	chatAddr = ln.Addr().String()
+
+	go broadcaster()
+	go timeouter()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(conn)
+		}
+	}()
+
+	os.Exit(m.Run())
+}
+
+const prompt = "Enter your name: "
+
+type chatter struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialChat(t *testing.T) *chatter {
+	t.Helper()
+	conn, err := net.Dial("tcp", chatAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &chatter{t, conn, bufio.NewReader(conn)}
+	c.prompt()
+	return c
+}
+
+func (c *chatter) prompt() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p := make([]byte, len(prompt))
+	if _, err := io.ReadFull(c.r, p); err != nil || string(p) != prompt {
+		c.t.Fatalf("Expected prompt, got %q (%v)", p, err)
+	}
+}
+
+// Connects, as name.
+func join(t *testing.T, name string) *chatter {
+	t.Helper()
+	c := dialChat(t)
+	c.say("%s", name)
+	c.expect("Connected as " + name)
+	return c
+}
+
+func (c *chatter) say(format string, args ...any) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, fmt.Sprintf(format, args...)+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Reads lines until exp; returns those read before.
+func (c *chatter) expect(exp string) []string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var skipped []string
+	for {
+		s, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("Expected %q, got %v (after %q)", exp, err, skipped)
+		}
+		s = strings.TrimSuffix(s, "\n")
+		if s == exp {
+			return skipped
+		}
+		skipped = append(skipped, s)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	for _, x := range []struct {
+		line, cmd, arg string
+	}{
+		{"hello", "", "hello"},
+		{"/msg bob  hi there", "msg", "bob  hi there"},
+		{"/who", "who", ""},
+		{"//not a command", "", "/not a command"},
+		{"", "", ""},
+	} {
+		cmd, arg := parseLine(x.line)
+		if cmd != x.cmd || arg != x.arg {
+			t.Errorf("%q: expected %q, %q, got %q, %q", x.line, x.cmd, x.arg, cmd, arg)
+		}
+	}
+}
+
+func TestChatCommands(t *testing.T) {
+	alice := join(t, "alice")
+	bob := join(t, "bob")
+	alice.expect("bob has entered the chat")
+	carol := join(t, "carol")
+	bob.expect("carol has entered the chat")
+
+	alice.say("hello")
+	bob.expect("alice: hello")
+	alice.expect("alice: hello")
+
+	alice.say("/me waves")
+	bob.expect("* alice waves")
+
+	alice.say("/msg bob psst")
+	bob.expect("alice (private): psst")
+	alice.expect("-> bob: psst")
+	carol.say("/who")
+	for _, s := range carol.expect("Users on #lobby: alice, bob, carol") {
+		if strings.Contains(s, "psst") {
+			t.Errorf("Private message leaked: %q", s)
+		}
+	}
+
+	alice.say("/msg nobody hi")
+	alice.expect("error: no such user: nobody")
+	alice.say("/msg bob")
+	alice.expect("error: usage: /msg <nick> <text>")
+	alice.say("/frob")
+	alice.expect("error: unknown command /frob (see /help)")
+	alice.say("/help")
+	alice.expect("Commands:")
+
+	// names are unique
+	alice.say("/nick bob")
+	alice.expect("error: name already taken: bob")
+	alice.say("/nick ali")
+	bob.expect("alice is now known as ali")
+	bob.say("/msg ali ok")
+	alice.expect("bob (private): ok")
+	bob.say("/msg alice ok")
+	bob.expect("error: no such user: alice")
+
+	c := dialChat(t)
+	c.say("bob")
+	c.expect(`Name "bob" is invalid, or already taken`)
+	c.prompt()
+	c.say("alice")
+	c.expect("Connected as alice")
+	c.expect("Users on #lobby: ali, alice, bob, carol")
+
+	bob.say("/quit")
+	carol.expect("bob has left the chat")
+	bob.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(bob.r); err != nil {
+		t.Errorf("Expected EOF after /quit, got %v", err)
+	}
+}
+
+func TestChatRooms(t *testing.T) {
+	dan := join(t, "dan")
+	erin := join(t, "erin")
+	frank := join(t, "frank")
+
+	dan.say("/join go")
+	dan.expect("error: usage: /join #<room>")
+	dan.say("/join #go")
+	erin.expect("dan has left #lobby")
+	dan.expect("dan has joined #go")
+	dan.say("/join #go")
+	dan.expect("error: already on #go")
+
+	dan.say("/topic")
+	dan.expect("No topic for #go")
+	dan.say("/topic gophers only")
+	dan.expect("dan set the topic of #go: gophers only")
+
+	erin.say("/join #go")
+	dan.expect("erin has joined #go")
+	erin.expect("Topic for #go: gophers only")
+	erin.say("/list")
+	erin.expect("Rooms: #go (2), #lobby (1)")
+	erin.say("/who")
+	erin.expect("Users on #go: dan, erin")
+
+	// only the room's members get its messages
+	dan.say("hi")
+	erin.expect("dan: hi")
+	frank.say("/who")
+	for _, s := range frank.expect("Users on #lobby: frank") {
+		if strings.Contains(s, "dan: hi") {
+			t.Errorf("Message leaked out of #go: %q", s)
+		}
+	}
+
+	dan.say("/part")
+	dan.expect("dan has left #go")
+	erin.expect("dan has left #go")
+	dan.say("hi")
+	dan.expect("error: not on any room (see /join)")
+	dan.say("/part")
+	dan.expect("error: not on any room")
+
+	// empty rooms are removed, topic included
+	erin.say("/part")
+	erin.expect("erin has left #go")
+	erin.say("/list")
+	erin.expect("Rooms: #lobby (1)")
+	erin.say("/join #go")
+	erin.say("/topic")
+	erin.expect("No topic for #go")
+}
+
+// Many clients, chatting at once in several rooms: each one gets
+// all its room's messages, and only those (go test -race).
+func TestChatRoomsConcurrent(t *testing.T) {
+	const rooms, members, msgs = 10, 5, 20
+
+	msgRe := regexp.MustCompile(`^\S+: msg (#\S+) \d+$`)
+
+	var cs []*chatter
+	for i := 0; i < rooms*members; i++ {
+		cs = append(cs, join(t, fmt.Sprintf("user%d", i)))
+	}
+
+	var joined, wg sync.WaitGroup
+	joined.Add(len(cs))
+	wg.Add(len(cs))
+	errs := make(chan error, len(cs))
+
+	for i, c := range cs {
+		go func() {
+			defer wg.Done()
+			name, r := fmt.Sprintf("user%d", i), fmt.Sprintf("#room%d", i%rooms)
+			c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+			// our messages are only sent once everyone's on
+			// their room
+			fmt.Fprintf(c.conn, "/join %s\n", r)
+			for {
+				s, err := c.r.ReadString('\n')
+				if err != nil {
+					joined.Done()
+					errs <- err
+					return
+				}
+				if s == name+" has joined "+r+"\n" {
+					break
+				}
+			}
+			joined.Done()
+			joined.Wait()
+
+			go func() {
+				for j := 0; j < msgs; j++ {
+					fmt.Fprintf(c.conn, "msg %s %d\n", r, j)
+				}
+			}()
+
+			for n := 0; n < members*msgs; {
+				s, err := c.r.ReadString('\n')
+				if err != nil {
+					errs <- fmt.Errorf("%s: got %d messages: %s", name, n, err)
+					return
+				}
+				m := msgRe.FindStringSubmatch(strings.TrimSuffix(s, "\n"))
+				if m == nil {
+					continue
+				}
+				if m[1] != r {
+					errs <- fmt.Errorf("%s, on %s: leaked message %q", name, r, s)
+					return
+				}
+				n++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// everyone left the lobby
+	cs[0].say("/list")
+	cs[0].expect("Rooms: " + strings.Join(roomCounts(rooms, members), ", "))
+}
+
+// e.g. "#room0 (5)", sorted as /list does.
+func roomCounts(rooms, members int) []string {
+	var xs []string
+	for i := 0; i < rooms; i++ {
+		xs = append(xs, fmt.Sprintf("#room%d (%d)", i, members))
+	}
+	sort.Strings(xs)
+	return xs
+}
@@ -35,235 +35,3191 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"path"
 	"path/filepath"
+	"errors"
+	"io/fs"
+	"unicode"
+	"sync"
+	"crypto/tls"
+	"math"
+	"log/slog"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"context"
+	"bytes"
+	"hash/fnv"
+	"slices"
+	"maps"
+	"math/rand/v2"
+	"time"
+	"cmp"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A client's session: the state of a control connection.
+type Session struct {
+	srv *Server
+	id  uint64
+
+	raw  net.Conn // as accepted
+	conn net.Conn // possibly upgraded to TLS, see replyConn
+	r    *bufio.Reader
+
+	user    string      // from USER, until PASS
+	account *Account    // once logged in
+	fs      FS          // the account's home, served as "/"
+	wd      string      // working directory, as a virtual path
+	usage   *quotaUsage // the account's, if it has a quota
+
+	typ  string   // TYPE: "A" or "I"
+	rest int64    // REST offset, for the next command only
+	rnfr string   // virtual path, for RNTO
+	mlst []string // facts selected by OPTS MLST
+
+	// FTPS
+	tls     bool
+	pbsz    bool
+	prot    string // "C" or "P", for the data connections
+	upgrade bool   // AUTH TLS: handshake once the reply is sent
+
+	// How to open the data connection: the client's address
+	// (active mode, PORT/EPRT), or our listener (passive mode,
+	// PASV/EPSV).
+	dataAddr string
+	dataLn   *net.TCPListener
+	epsvAll  bool
+
+	xfer *transfer // the running transfer, if any
+	rate *bucket   // bandwidth limit, if any
+}
+
+// Data transfers run in their own goroutine, so that the control
+// connection can still be read, e.g. for ABOR; other commands wait
+// for the transfer to be over (see serve()).
+type transfer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Runs f over the data connection, in the background, then closes
+// it and replies: 226 on success, 426 if aborted, or code and f's
+// error (unless it's a codeError). done, if any, is called once f
+// returns (e.g. to close the file); its error is reported as f's.
+// f returns the number of bytes transferred, for the xferlog (if
+// xl isn't nil, i.e. for files).
+//
+// f doesn't run in the session's goroutine: it mustn't use sess;
+// ctx is cancelled when the transfer is aborted.
+func startData(conn net.Conn, sess *Session, code int, xl *xferEntry, f func(ctx context.Context, sock net.Conn) (int64, error), done func() error) {
+	open := dataOpener(conn, sess)
+	l := sess.logger()
+	srv := sess.srv
+	start := time.Now()
+
+	// aborted by ABOR, or when the server is shut down
+	c, cancel := context.WithCancel(sess.srv.kill)
+	t := &transfer{cancel, make(chan struct{})}
+	sess.xfer = t
+
+	go func() {
+		defer close(t.done)
+		defer cancel()
+
+		sock, err := open(c)
+		if err != nil {
+			if done != nil {
+				done()
+			}
+			fmt.Fprintf(conn, "425 Can't open data connection: %s\r\n", err)
+			l.Info("transfer", "code", 425, "error", err.Error())
+			return
+		}
+
+		// unblocks f
+		stop := context.AfterFunc(c, func() { sock.Close() })
+		n, err := f(c, sock)
+		if done != nil {
+			if err2 := done(); err == nil {
+				err = err2
+			}
+		}
+		stop()
+
+		// at least log it
+		if err2 := sock.Close(); err2 != nil && err == nil {
+			log.Printf("error: failed to close socket: %s\n", err2)
+		}
+
+		if xl != nil {
+			srv.xferlog(xl, start, n, err == nil)
+		}
+
+		var ce *codeError
+		switch {
+		case err != nil && c.Err() != nil:
+			code = 426
+			fmt.Fprintf(conn, "426 Transfer aborted\r\n")
+		case errors.As(err, &ce):
+			code = ce.code
+			fmt.Fprintf(conn, "%d %s\r\n", code, ce.msg)
+		case err != nil:
+			fmt.Fprintf(conn, "%d failed: %s\r\n", code, err)
+		default:
+			code = 226
+			fmt.Fprintf(conn, "226 Transfer complete\r\n")
+		}
+		l.Info("transfer", "code", code, "bytes", n, "duration", time.Since(start))
+	}()
+}
+
+// An error with its own reply code.
+type codeError struct {
+	code int
+	msg  string
+}
+
+func (e *codeError) Error() string {
+	return e.msg
+}
+
+// What's logged for a file transfer (see Server.Xferlog).
+type xferEntry struct {
+	host     string
+	file     string // virtual path
+	ascii    bool
+	incoming bool
+	account  Account
+}
+
+func newXferEntry(sess *Session, file string, incoming bool) *xferEntry {
+	return &xferEntry{
+		host:     remoteIP(sess.raw),
+		file:     file,
+		ascii:    isASCII(sess),
+		incoming: incoming,
+		account:  *sess.account,
+	}
+}
+
+// Cancels the running transfer, if any, and waits for it; returns
+// whether it was still running.
+func abortData(sess *Session) bool {
+	t := sess.xfer
+	if t == nil {
+		return false
+	}
+	sess.xfer = nil
+
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	t.cancel()
+	<-t.done
+	return true
+}
+
+// Waits for the running transfer, if any.
+func waitData(sess *Session) {
+	if sess.xfer != nil {
+		<-sess.xfer.done
+		sess.xfer = nil
+	}
+}
+
+func abor(conn net.Conn, _ string, sess *Session) {
+	if abortData(sess) {
+		// after the transfer's 426
+		fmt.Fprintf(conn, "226 Abort successful\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "225 No transfer in progress\r\n")
+}
+
+// REST offset: the next RETR or STOR starts at offset (a file
+// offset, even in ASCII mode), instead of the beginning.
+func rest(conn net.Conn, arg string, sess *Session) {
+	off, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || off < 0 {
+		fmt.Fprintf(conn, "501 invalid offset '%s'\r\n", arg)
+		return
+	}
+	sess.rest = off
+	fmt.Fprintf(conn, "350 Restarting at %d. Send STOR or RETR\r\n", off)
+}
+
+// Moves to the REST offset, if any, which can't be past the end
+// of fd; failures are reported to the client.
+func restart(conn net.Conn, fd File, fn string, sess *Session) bool {
+	off := sess.rest
+	if off == 0 {
+		return true
+	}
+
+	fi, err := fd.Stat()
+	if err == nil && off > fi.Size() {
+		fmt.Fprintf(conn, "554 %s: restart offset %d past the end of file (%d)\r\n", fn, off, fi.Size())
+		return false
+	}
+	if err == nil {
+		_, err = fd.Seek(off, io.SeekStart)
+	}
+	if err != nil {
+		replyErr(conn, 451, fn, err)
+		return false
+	}
+	return true
+}
+
+// A directory entry, as listed: symlinks are followed (they are
+// skipped when pointing outside of the root, or nowhere).
+type entry struct {
+	name string
+	fi   fs.FileInfo
+	path string // virtual path
+}
+
+// Entries of arg, a directory (its content) or a file (itself);
+// errors are reported to the client.
+func listing(conn net.Conn, arg string, sess *Session) ([]entry, bool) {
+	v := vpath(arg, sess)
+	fi, err := sess.fs.Stat(v)
+	if err != nil {
+		replyErr(conn, 550, arg, err)
+		return nil, false
+	}
+	if !fi.IsDir() {
+		return []entry{{path.Base(v), fi, v}}, true
+	}
+
+	fis, err := sess.fs.ReadDir(v)
+	if err != nil {
+		replyErr(conn, 550, arg, err)
+		return nil, false
+	}
+
+	es := make([]entry, len(fis))
+	for i, fi := range fis {
+		es[i] = entry{fi.Name(), fi, path.Join(v, fi.Name())}
+	}
+	return es, true
+}
+
+// Options, as in "LIST -la", are ignored.
+func stripOptions(arg string) string {
+	for strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	return arg
+}
+
+// Sends the entries of arg, one per line, formatted by f.
+func sendListing(conn net.Conn, arg string, sess *Session, f func(entry) string) {
+	if !hasData(conn, sess) {
+		return
+	}
+	es, ok := listing(conn, arg, sess)
+	if !ok {
+		return
+	}
+
+	var b bytes.Buffer
+	for _, e := range es {
+		fmt.Fprintf(&b, "%s\r\n", f(e))
+	}
+
+	_, err := fmt.Fprintf(conn, "150 Here comes the directory listing\r\n")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	startData(conn, sess, 426, nil, func(_ context.Context, sock net.Conn) (int64, error) {
+		return b.WriteTo(sock)
+	}, nil)
+}
+
+// As ls -l, e.g.
+//
+//	-rw-r--r-- 1 ftp ftp         1234 Jan  2 15:04 file
+//	drwxr-xr-x 1 ftp ftp         4096 Mar 14  2021 dir
+//
+// with the year instead of the time for entries older than six
+// months (or in the future); owners aren't disclosed, and times
+// are in UTC.
+func lsLine(e entry, now time.Time) string {
+	t := e.fi.ModTime().UTC()
+	date := t.Format("Jan _2 15:04")
+	if t.Before(now.AddDate(0, -6, 0)) || t.After(now.Add(time.Hour)) {
+		date = t.Format("Jan _2  2006")
+	}
+
+	kind := "-"
+	if e.fi.IsDir() {
+		kind = "d"
+	}
+	return fmt.Sprintf("%s%s 1 ftp ftp %12d %s %s",
+		kind, e.fi.Mode().Perm().String()[1:], e.fi.Size(), date, e.name)
+}
+
+func list(conn net.Conn, arg string, sess *Session) {
+	now := time.Now().UTC()
+	sendListing(conn, stripOptions(arg), sess, func(e entry) string {
+		return lsLine(e, now)
+	})
+}
+
+func nlst(conn net.Conn, arg string, sess *Session) {
+	sendListing(conn, stripOptions(arg), sess, func(e entry) string {
+		return e.name
+	})
+}
+
+// RFC 3659 facts, in the order we list them.
+var mlstFacts = []string{"type", "size", "modify", "perm", "unique"}
+
+// e.g. "type=file;size=1234;modify=20240102150405;perm=adfrw;unique=1a2b3c;"
+func facts(e entry, sess *Session) string {
+	write := sess.account != nil && sess.account.Write
+
+	var b strings.Builder
+	for _, f := range sess.mlst {
+		var v string
+		switch f {
+		case "type":
+			v = "file"
+			if e.fi.IsDir() {
+				v = "dir"
+			}
+		case "size":
+			v = strconv.FormatInt(e.fi.Size(), 10)
+		case "modify":
+			v = e.fi.ModTime().UTC().Format("20060102150405")
+		case "perm":
+			// r: RETR, a: APPE, w: STOR, d: DELE/RMD, f: RNFR,
+			// e: CWD, l: LIST, c: STOR in, m: MKD, p: purge
+			switch {
+			case e.fi.IsDir() && write:
+				v = "cdeflmp"
+			case e.fi.IsDir():
+				v = "el"
+			case write:
+				v = "adfrw"
+			default:
+				v = "r"
+			}
+		case "unique":
+			id, err := fileID(sess.fs, e.path)
+			if err != nil {
+				id = e.path
+			}
+			h := fnv.New64a()
+			io.WriteString(h, id)
+			v = strconv.FormatUint(h.Sum64(), 16)
+		}
+		b.WriteString(f + "=" + v + ";")
+	}
+	return b.String()
+}
+
+func mlsd(conn net.Conn, arg string, sess *Session) {
+	fi, err := sess.fs.Stat(vpath(arg, sess))
+	if err != nil {
+		replyErr(conn, 550, arg, err)
+		return
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(conn, "501 %s: Not a directory\r\n", arg)
+		return
+	}
+	sendListing(conn, arg, sess, func(e entry) string {
+		return facts(e, sess) + " " + e.name
+	})
+}
+
+// Over the control connection
+func mlst(conn net.Conn, arg string, sess *Session) {
+	v := vpath(arg, sess)
+	fi, err := sess.fs.Stat(v)
+	if err != nil {
+		replyErr(conn, 550, arg, err)
+		return
+	}
+	fmt.Fprintf(conn, "250-Listing %s\r\n %s %s\r\n250 End\r\n", v, facts(entry{v, fi, v}, sess), v)
+}
+
+// RFC 2389
+func feat(conn net.Conn, _ string, sess *Session) {
+	var b strings.Builder
+	b.WriteString("211-Features:\r\n")
+
+	var mlst string
+	for _, f := range mlstFacts {
+		mlst += f
+		if slices.Contains(sess.mlst, f) {
+			mlst += "*"
+		}
+		mlst += ";"
+	}
+
+	feats := []string{
+		"EPRT", "EPSV", "MDTM", "MLST " + mlst, "PASV",
+		"REST STREAM", "SIZE", "TVFS", "UTF8",
+	}
+	if sess.srv.TLSConfig != nil {
+		feats = append(feats, "AUTH TLS", "PBSZ", "PROT")
+	}
+	slices.Sort(feats)
+	for _, f := range feats {
+		b.WriteString(" " + f + "\r\n")
+	}
+	b.WriteString("211 End\r\n")
+	io.WriteString(conn, b.String())
+}
+
+func opts(conn net.Conn, arg string, sess *Session) {
+	name, val, _ := strings.Cut(arg, " ")
+	switch strings.ToUpper(name) {
+	case "UTF8":
+		// paths are always UTF-8
+		if strings.ToUpper(val) != "ON" {
+			fmt.Fprintf(conn, "501 only UTF8 ON\r\n")
+			return
+		}
+		fmt.Fprintf(conn, "200 UTF8 ON\r\n")
+	case "MLST":
+		// unknown facts are ignored
+		want := strings.Split(strings.ToLower(val), ";")
+		sel := []string{}
+		for _, f := range mlstFacts {
+			if slices.Contains(want, f) {
+				sel = append(sel, f)
+			}
+		}
+		sess.mlst = sel
+		fmt.Fprintf(conn, "200 MLST OPTS %s\r\n", strings.Join(append(sel, ""), ";"))
+	default:
+		fmt.Fprintf(conn, "501 unexpected OPTS %s\r\n", arg)
+	}
+}
+
+func pwd(conn net.Conn, _ string, sess *Session) {
+	fmt.Fprintf(conn, "257 \"%s\" is current directory\r\n", strings.ReplaceAll(sess.wd, `"`, `""`))
+}
+
+func retr(conn net.Conn, fn string, sess *Session) {
+	if fn == "" {
+		fmt.Fprintf(conn, "501 No file specified\r\n")
+		return
+	}
+
+	if !hasData(conn, sess) {
+		return
+	}
+
+	v := vpath(fn, sess)
+	fd, err := sess.fs.Open(v)
+	if err != nil {
+		replyErr(conn, 550, fn, err)
+		return
+	}
+
+	if fi, err := fd.Stat(); err != nil || !fi.Mode().IsRegular() {
+		fd.Close()
+		fmt.Fprintf(conn, "550 %s: Not a regular file\r\n", fn)
+		return
+	}
+	if !restart(conn, fd, fn, sess) {
+		fd.Close()
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "150 Opening data connection\r\n")
+	if err != nil {
+		log.Println(err)
+		fd.Close()
+		return
+	}
+
+	ascii := isASCII(sess)
+	limits := sess.limits()
+	startData(conn, sess, 426, newXferEntry(sess, v, false), func(ctx context.Context, sock net.Conn) (int64, error) {
+		w := limit(ctx, sock, limits)
+		if ascii {
+			w = &toCRLF{w: w}
+		}
+		return io.Copy(w, fd)
+	}, fd.Close)
+}
+
+func cwd(conn net.Conn, arg string, sess *Session) {
+	if arg == "" {
+		fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
+		return
+	}
+
+	v := vpath(arg, sess)
+	fi, err := sess.fs.Stat(v)
+	if err != nil {
+		replyErr(conn, 550, arg, err)
+		return
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(conn, "550 %s: Not a directory\r\n", arg)
+		return
+	}
+	sess.wd = v
+
+	fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
+}
+
+func cdup(conn net.Conn, _ string, sess *Session) {
+	cwd(conn, "..", sess)
+}
+
+// A user, once logged in.
+type Account struct {
+	Name string
+
+	// Served as "/"; relative to Server.Root,
+	// if not absolute. With Server.FS, a directory of it.
+	Home string
+
+	// Whether the user can upload, delete, rename files,
+	// or create and remove directories.
+	Write bool
+
+	// Maximum total size of the files in Home, enforced on
+	// uploads (0: no limit).
+	Quota int64
+
+	// Anonymous users: the password, by convention an e-mail
+	// address (see xferlog).
+	Anonymous bool
+	Email     string
+}
+
+var errLogin = errors.New("Login incorrect")
+
+type Authenticator interface {
+	// Authenticate returns user's account, if pass is correct;
+	// errLogin otherwise (or any other error, e.g. I/O).
+	Authenticate(user, pass string) (*Account, error)
+}
+
+// Anonymous FTP (RFC 1635): "anonymous" or "ftp", with any
+// password (by convention, an e-mail address).
+type Anonymous struct {
+	Home  string
+	Write bool
+	Quota int64
+}
+
+func (a Anonymous) Authenticate(user, pass string) (*Account, error) {
+	if user != "anonymous" && user != "ftp" {
+		return nil, errLogin
+	}
+	return &Account{
+		Name:      user,
+		Home:      a.Home,
+		Write:     a.Write,
+		Quota:     a.Quota,
+		Anonymous: true,
+		Email:     pass,
+	}, nil
+}
+
+// Users from an htpasswd-like file, e.g. created with
+// Apache's htpasswd -B (only bcrypt is supported), with three
+// optional fields: the home directory (defaults to the root
+// one), the permissions (r, the default, or rw), and the upload
+// quota (e.g. 100M; none by default, see parseSize):
+//
+//	# user:hash[:home[:perms[:quota]]]
+//	alice:$2y$10$...:alice:rw:1G
+//	bob:$2y$10$...
+type Htpasswd struct {
+	users map[string]htpasswdEntry
+}
+
+type htpasswdEntry struct {
+	hash    []byte
+	account Account
+}
+
+func LoadHtpasswd(fn string) (*Htpasswd, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ReadHtpasswd(fd)
+}
+
+func ReadHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{make(map[string]htpasswdEntry)}
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		xs := strings.Split(line, ":")
+		if len(xs) < 2 || len(xs) > 5 || xs[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash[:home[:perms[:quota]]]", n)
+		}
+		if _, err := bcrypt.Cost([]byte(xs[1])); err != nil {
+			return nil, fmt.Errorf("line %d: %s: not a bcrypt hash: %s", n, xs[0], err)
+		}
+
+		e := htpasswdEntry{[]byte(xs[1]), Account{Name: xs[0]}}
+		if len(xs) > 2 {
+			e.account.Home = xs[2]
+		}
+		if len(xs) > 3 {
+			switch xs[3] {
+			case "r":
+			case "rw":
+				e.account.Write = true
+			default:
+				return nil, fmt.Errorf("line %d: unexpected permissions %s", n, xs[3])
+			}
+		}
+		if len(xs) > 4 {
+			q, err := parseSize(xs[4])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quota: %s", n, err)
+			}
+			e.account.Quota = q
+		}
+		h.users[xs[0]] = e
+	}
+	return h, sc.Err()
+}
+
+// Parses a number of bytes, with an optional K, M, G or T
+// (binary) suffix, e.g. 512K.
+func parseSize(s string) (int64, error) {
+	num, mul := s, int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		mul = 1 << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		num = s[:i]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * mul, nil
+}
+
+// Compared against, for unknown users, so that they can't be
+// told apart from known ones by the response time.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func (h *Htpasswd) Authenticate(user, pass string) (*Account, error) {
+	e, ok := h.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return nil, errLogin
+	}
+	if bcrypt.CompareHashAndPassword(e.hash, []byte(pass)) != nil {
+		return nil, errLogin
+	}
+	a := e.account
+	return &a, nil
+}
+
+// Tries each Authenticator in turn.
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(user, pass string) (*Account, error) {
+	for _, a := range as {
+		acc, err := a.Authenticate(user, pass)
+		if err != errLogin {
+			return acc, err
+		}
+	}
+	return nil, errLogin
+}
+
+// Failed logins, per IP: past max within window, further
+// attempts are rejected, until older failures expire.
+type loginFailures struct {
+	mu  sync.Mutex
+	ips map[string][]time.Time
+
+	max    int
+	window time.Duration
+}
+
+// Failures of ip which haven't expired yet; the lock is held.
+func (f *loginFailures) recent(ip string) []time.Time {
+	ts := f.ips[ip]
+	for len(ts) > 0 && time.Since(ts[0]) > f.window {
+		ts = ts[1:]
+	}
+	if len(ts) == 0 {
+		delete(f.ips, ip)
+	} else {
+		f.ips[ip] = ts
+	}
+	return ts
+}
+
+func (f *loginFailures) blocked(ip string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.recent(ip)) >= f.max
+}
+
+func (f *loginFailures) add(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ips[ip] = append(f.recent(ip), time.Now())
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Whether the client is still allowed to try to log in; the
+// connection is closed if not.
+func canLogin(conn net.Conn, sess *Session) bool {
+	if !sess.srv.failures.blocked(remoteIP(conn)) {
+		return true
+	}
+	fmt.Fprintf(conn, "421 Too many failed logins, try again later\r\n")
+	conn.Close()
+	return false
+}
+
+// USER starts a new login, even when already logged in.
+func user(conn net.Conn, user string, sess *Session) {
+	if !canLogin(conn, sess) {
+		return
+	}
+	sess.logout()
+	if user == "" {
+		fmt.Fprintf(conn, "501 No user name specified\r\n")
+		return
+	}
+	sess.user = user
+	fmt.Fprintf(conn, "331 Please specify the password\r\n")
+}
+
+func pass(conn net.Conn, pass string, sess *Session) {
+	if !canLogin(conn, sess) {
+		return
+	}
+	if sess.account != nil {
+		fmt.Fprintf(conn, "230 Already logged in\r\n")
+		return
+	}
+	name := sess.user
+	if name == "" {
+		fmt.Fprintf(conn, "503 Login with USER first\r\n")
+		return
+	}
+	sess.user = ""
+
+	acc, err := sess.srv.auth().Authenticate(name, pass)
+	if err != nil {
+		if err != errLogin {
+			log.Printf("%s: authentication failed: %s\n", name, err)
+		}
+		sess.srv.failures.add(remoteIP(conn))
+		fmt.Fprintf(conn, "530 Login incorrect\r\n")
+		return
+	}
+
+	fsys, err := sess.srv.home(acc)
+	if err != nil {
+		log.Printf("%s: invalid home directory '%s': %s\n", name, acc.Home, err)
+		fmt.Fprintf(conn, "530 Login incorrect\r\n")
+		return
+	}
+
+	var u *quotaUsage
+	if acc.Quota > 0 {
+		if u, err = sess.srv.acquireUsage(fsys); err != nil {
+			log.Printf("%s: can't compute the quota usage: %s\n", name, err)
+			replyErr(conn, 451, "", err)
+			return
+		}
+	}
+
+	sess.account = acc
+	sess.fs = fsys
+	sess.wd = "/"
+	sess.usage = u
+	fmt.Fprintf(conn, "230 Login successful\r\n")
+}
+
+// Forgets the account sess is logged in as, if any.
+func (sess *Session) logout() {
+	if sess.usage != nil {
+		sess.srv.releaseUsage(sess.usage)
+	}
+	sess.account, sess.usage = nil, nil
+}
+
+// Commands accepted before login
+var noLogin = map[string]bool{
+	"USER" : true,
+	"PASS" : true,
+	"QUIT" : true,
+	"AUTH" : true,
+	"PBSZ" : true,
+	"PROT" : true,
+	"FEAT" : true,
+	"OPTS" : true,
+}
+
+// Commands modifying the filesystem
+var writeCmds = map[string]bool{
+	"STOR" : true,
+	"APPE" : true,
+	"STOU" : true,
+	"DELE" : true,
+	"MKD"  : true,
+	"XMKD" : true,
+	"RMD"  : true,
+	"XRMD" : true,
+	"RNFR" : true,
+	"RNTO" : true,
+}
+
+// Whether the logged in user (if any) can run cmd; the client
+// is told when not.
+func allowed(conn net.Conn, cmd string, sess *Session) bool {
+	if sess.srv.TLSRequired && !sess.tls && cmd != "AUTH" && cmd != "QUIT" {
+		fmt.Fprintf(conn, "530 TLS required, use AUTH TLS\r\n")
+		return false
+	}
+	if noLogin[cmd] {
+		return true
+	}
+	if sess.account == nil {
+		fmt.Fprintf(conn, "530 Please login with USER and PASS\r\n")
+		return false
+	}
+	if writeCmds[cmd] && !sess.account.Write {
+		fmt.Fprintf(conn, "550 Permission denied\r\n")
+		return false
+	}
+	return true
+}
+
+func syst(conn net.Conn, _ string, sess *Session) {
+	fmt.Fprintf(conn, "215 ftpd.go\r\n")
+}
+
+func quit(conn net.Conn, _ string, sess *Session) {
+	fmt.Fprintf(conn, "221 Goodbye\r\n")
+	conn.Close()
+}
+
+// Active mode: we'll connect to the client, when needed. To
+// prevent bounce attacks, only the client's own IP is accepted.
+func active(conn net.Conn, ip net.IP, port int, sess *Session) {
+	if sess.epsvAll {
+		fmt.Fprintf(conn, "503 EPSV ALL in effect\r\n")
+		return
+	}
+	if port <= 0 || port > 65535 {
+		fmt.Fprintf(conn, "501 invalid port %d\r\n", port)
+		return
+	}
+	raddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if raddr == nil || !raddr.IP.Equal(ip) {
+		fmt.Fprintf(conn, "500 Illegal PORT command: %s is not the client's address\r\n", ip)
+		return
+	}
+
+	closeData(sess)
+	sess.dataAddr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	fmt.Fprintf(conn, "200 PORT command successful\r\n")
+}
+
+// PORT h1,h2,h3,h4,p1,p2
+func port(conn net.Conn, args string, sess *Session) {
+	xs := strings.Split(args, ",")
+	if len(xs) != 6 {
+		fmt.Fprintf(conn, "501 unexpected PORT value %s\r\n", args)
+		return
+	}
+
+	ip := net.ParseIP(strings.Join(xs[0:4], ".")).To4()
+	if ip == nil {
+		fmt.Fprintf(conn, "501 unexpected PORT address %s\r\n", args)
+		return
+	}
+
+	ph, err := strconv.Atoi(xs[4])
+	if err != nil || ph < 0 || ph > 255 {
+		fmt.Fprintf(conn, "501 %s is not a byte\r\n", xs[4])
+		return
+	}
+	pl, err := strconv.Atoi(xs[5])
+	if err != nil || pl < 0 || pl > 255 {
+		fmt.Fprintf(conn, "501 %s is not a byte\r\n", xs[5])
+		return
+	}
+
+	active(conn, ip, ph*256+pl, sess)
+}
+
+// EPRT |proto|addr|port| (RFC 2428), where '|' can be any
+// delimiter; proto 1 is IPv4, 2 is IPv6.
+func eprt(conn net.Conn, args string, sess *Session) {
+	if len(args) < 1 {
+		fmt.Fprintf(conn, "501 unexpected EPRT value %s\r\n", args)
+		return
+	}
+	xs := strings.Split(args, args[:1])
+	if len(xs) != 5 || xs[0] != "" || xs[4] != "" {
+		fmt.Fprintf(conn, "501 unexpected EPRT value %s\r\n", args)
+		return
+	}
+
+	ip := net.ParseIP(xs[2])
+	switch {
+	case xs[1] != "1" && xs[1] != "2":
+		fmt.Fprintf(conn, "522 Network protocol not supported, use (1,2)\r\n")
+		return
+	case ip == nil || (xs[1] == "1") != (ip.To4() != nil):
+		fmt.Fprintf(conn, "501 unexpected EPRT address %s\r\n", xs[2])
+		return
+	}
+
+	port, err := strconv.Atoi(xs[3])
+	if err != nil {
+		fmt.Fprintf(conn, "501 %s is not an integer: %s\r\n", xs[3], err)
+		return
+	}
+
+	active(conn, ip, port, sess)
+}
+
+// Listens on the control connection's local IP, in srv's passive
+// port range.
+func listenPassive(conn net.Conn, srv *Server) (*net.TCPListener, error) {
+	laddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	if laddr == nil {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+
+	pasvMin, pasvMax := srv.PasvMin, srv.PasvMax
+	if pasvMin <= 0 || pasvMax < pasvMin {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: laddr.IP})
+	}
+
+	// start at a random port, so that concurrent sessions
+	// don't compete for the same ones
+	n := pasvMax - pasvMin + 1
+	off := rand.IntN(n)
+	var err error
+	for i := 0; i < n; i++ {
+		p := pasvMin + (off+i)%n
+		var ln *net.TCPListener
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: laddr.IP, Port: p})
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no passive port available in %d-%d: %s", pasvMin, pasvMax, err)
+}
+
+// Passive mode: we listen, and the client connects. The
+// listener's port is returned.
+func passive(conn net.Conn, sess *Session) (int, bool) {
+	closeData(sess)
+
+	ln, err := listenPassive(conn, sess.srv)
+	if err != nil {
+		fmt.Fprintf(conn, "425 failed: %s\r\n", err)
+		return 0, false
+	}
+	sess.dataLn = ln
+	return ln.Addr().(*net.TCPAddr).Port, true
+}
+
+func pasv(conn net.Conn, _ string, sess *Session) {
+	if sess.epsvAll {
+		fmt.Fprintf(conn, "503 EPSV ALL in effect\r\n")
+		return
+	}
+
+	var ip net.IP
+	if a := sess.srv.PasvAddr; a != "" {
+		ip = net.ParseIP(a).To4()
+	} else if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = laddr.IP.To4()
+	}
+	if ip == nil {
+		// e.g. IPv6
+		fmt.Fprintf(conn, "425 No IPv4 address to advertise, use EPSV\r\n")
+		return
+	}
+
+	port, ok := passive(conn, sess)
+	if !ok {
+		return
+	}
+	fmt.Fprintf(conn, "227 Entering Passive Mode (%d,%d,%d,%d,%d,%d)\r\n",
+		ip[0], ip[1], ip[2], ip[3], port/256, port%256)
+}
+
+// EPSV [proto|ALL] (RFC 2428): only the port is given, the client
+// connects to the same address as the control connection.
+func epsv(conn net.Conn, arg string, sess *Session) {
+	laddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	proto := "2"
+	if laddr != nil && laddr.IP.To4() != nil {
+		proto = "1"
+	}
+
+	switch strings.ToUpper(arg) {
+	case "ALL":
+		sess.epsvAll = true
+		fmt.Fprintf(conn, "200 EPSV ALL ok\r\n")
+		return
+	case "", proto:
+	default:
+		fmt.Fprintf(conn, "522 Network protocol not supported, use (%s)\r\n", proto)
+		return
+	}
+
+	port, ok := passive(conn, sess)
+	if !ok {
+		return
+	}
+	fmt.Fprintf(conn, "229 Entering Extended Passive Mode (|||%d|)\r\n", port)
+}
+
+// How long to wait for the client to connect, in passive mode
+// (or for the client to accept our connection, in active mode).
+const dataTimeout = 30 * time.Second
+
+// Whether PORT/EPRT or PASV/EPSV has been issued; the client is
+// told when not.
+func hasData(conn net.Conn, sess *Session) bool {
+	if sess.dataAddr == "" && sess.dataLn == nil {
+		fmt.Fprintf(conn, "425 Use PORT or PASV first\r\n")
+		return false
+	}
+	if sess.srv.TLSRequired && sess.prot != "P" {
+		fmt.Fprintf(conn, "521 Data connections must be protected (PROT P)\r\n")
+		return false
+	}
+	return true
+}
+
+// Returns how to open the data socket. What's needed is taken
+// from sess now, as the socket is opened from the transfer's
+// goroutine (see startData()).
+func dataOpener(conn net.Conn, sess *Session) func(c context.Context) (net.Conn, error) {
+	ln, addr, prot := sess.dataLn, sess.dataAddr, sess.prot == "P"
+	conf := sess.srv.TLSConfig
+
+	// one connection per PASV
+	sess.dataLn = nil
+
+	return func(c context.Context) (net.Conn, error) {
+		var sock net.Conn
+		var err error
+
+		if ln != nil {
+			defer ln.Close()
+			stop := context.AfterFunc(c, func() { ln.Close() })
+			defer stop()
+			sock, err = acceptData(conn, ln)
+		} else if addr != "" {
+			d := net.Dialer{Timeout: dataTimeout}
+			sock, err = d.DialContext(c, "tcp", addr)
+		} else {
+			err = fmt.Errorf("no data connection")
+		}
+
+		if err == nil && prot {
+			sock, err = protect(c, sock, conf)
+		}
+		return sock, err
+	}
+}
+
+// TLS server side of conn; the handshake is performed now.
+func protect(ctx context.Context, conn net.Conn, conf *tls.Config) (net.Conn, error) {
+	c := tls.Server(conn, conf)
+	c.SetDeadline(time.Now().Add(dataTimeout))
+	if err := c.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// AUTH TLS: the control connection is upgraded, once the
+// reply has been sent (see serve()).
+func authTLS(conn net.Conn, arg string, sess *Session) {
+	if sess.srv.TLSConfig == nil {
+		fmt.Fprintf(conn, "502 TLS not configured\r\n")
+		return
+	}
+	if sess.tls {
+		fmt.Fprintf(conn, "503 Already using TLS\r\n")
+		return
+	}
+	switch strings.ToUpper(arg) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		fmt.Fprintf(conn, "504 AUTH %s not supported\r\n", arg)
+		return
+	}
+
+	fmt.Fprintf(conn, "234 AUTH TLS successful\r\n")
+	sess.upgrade = true
+}
+
+// PBSZ is meaningless for TLS, but mandatory before PROT.
+func pbsz(conn net.Conn, arg string, sess *Session) {
+	if !sess.tls {
+		fmt.Fprintf(conn, "503 AUTH TLS first\r\n")
+		return
+	}
+	sess.pbsz = true
+	fmt.Fprintf(conn, "200 PBSZ=0\r\n")
+}
+
+// PROT C(lear) or P(rivate), for the data connections.
+func prot(conn net.Conn, arg string, sess *Session) {
+	if !sess.pbsz {
+		fmt.Fprintf(conn, "503 PBSZ first\r\n")
+		return
+	}
+	switch strings.ToUpper(arg) {
+	case "C":
+		if sess.srv.TLSRequired {
+			fmt.Fprintf(conn, "534 Data connections must be protected\r\n")
+			return
+		}
+		sess.prot = "C"
+	case "P":
+		sess.prot = "P"
+	case "S", "E":
+		fmt.Fprintf(conn, "536 PROT %s not supported\r\n", arg)
+		return
+	default:
+		fmt.Fprintf(conn, "504 unexpected PROT %s\r\n", arg)
+		return
+	}
+	fmt.Fprintf(conn, "200 PROT set to %s\r\n", sess.prot)
+}
+
+// Accepts a connection from the client, and only from the
+// client (the port could have been guessed by someone else).
+func acceptData(conn net.Conn, ln *net.TCPListener) (net.Conn, error) {
+	raddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	ln.SetDeadline(time.Now().Add(dataTimeout))
+	for {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if raddr != nil && c.RemoteAddr().(*net.TCPAddr).IP.Equal(raddr.IP) {
+			return c, nil
+		}
+		log.Printf("rejecting data connection from %s\n", c.RemoteAddr())
+		c.Close()
+	}
+}
+
+// Forgets about the data connection, e.g. before a new PORT
+// or PASV, or at the end of the session.
+func closeData(sess *Session) {
+	abortData(sess)
+	if sess.dataLn != nil {
+		sess.dataLn.Close()
+	}
+	sess.dataLn, sess.dataAddr = nil, ""
+}
+
+var errJail = errors.New("Permission denied")
+
+// Virtual path for arg, i.e. as seen by the client: relative to
+// the working directory, if not absolute, and where the root is
+// the root directory (e.g. "/../a" is "/a").
+func vpath(arg string, sess *Session) string {
+	if !path.IsAbs(arg) {
+		arg = path.Join(sess.wd, arg)
+	}
+	return path.Clean("/" + arg)
+}
+
+// Whether p is r, or inside r.
+func within(r, p string) bool {
+	rel, err := filepath.Rel(r, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Real path of v, a virtual path, checked to stay inside the root
+// directory, following symlinks. v needs not exist, but its parent
+// directory must.
+//
+// NOTE: there's a window between the check and the use of the
+// path, during which a local user could swap a directory for
+// a symlink; FTP users can't create symlinks though.
+func realPath(root, v string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(v))
+	q, err := filepath.EvalSymlinks(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		// e.g. STOR, MKD: resolve the parent directory
+		var dir string
+		if dir, err = filepath.EvalSymlinks(filepath.Dir(p)); err != nil {
+			return "", err
+		}
+		q = filepath.Join(dir, filepath.Base(p))
+
+		// a dangling symlink, which would be followed on creation
+		if _, err := os.Lstat(q); err == nil {
+			return "", errJail
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if !within(root, q) {
+		return "", errJail
+	}
+	return q, nil
+}
+
+// FS is what's served: a local directory (DirFS), memory (MemFS),
+// or any io/fs.FS, read-only (see ReadOnly). Names are virtual
+// paths ("/" being the root, see vpath()), which an FS keeps from
+// escaping its root.
+type FS interface {
+	Open(name string) (File, error)
+
+	// Create opens name for writing, as os.OpenFile with flag,
+	// i.e. os.O_WRONLY|os.O_CREATE, plus os.O_TRUNC, O_APPEND,
+	// or O_EXCL.
+	Create(name string, flag int) (File, error)
+
+	Stat(name string) (fs.FileInfo, error)
+
+	// ReadDir returns the entries of a directory, sorted by
+	// name; symlinks, if any, are followed (those that can't
+	// be are skipped).
+	ReadDir(name string) ([]fs.FileInfo, error)
+
+	Rename(from, to string) error
+	Remove(name string) error
+	Mkdir(name string, perm fs.FileMode) error
+}
+
+// An open file of an FS; *os.File is one.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Implemented by filesystems where a file can have several names
+// (e.g. symlinks): name's file ID, the same for all its names.
+type FileIDer interface {
+	FileID(name string) (string, error)
+}
+
+// e.g. for MLST's unique fact
+func fileID(fsys FS, name string) (string, error) {
+	if f, ok := fsys.(FileIDer); ok {
+		return f.FileID(name)
+	}
+	return path.Clean("/" + name), nil
+}
+
+// DirFS serves a local directory; symlinks are followed, as long
+// as they stay inside (see realPath()).
+type DirFS string
+
+func (d DirFS) real(name string) (string, error) {
+	return realPath(string(d), path.Clean("/"+name))
+}
+
+// As real(), but only name's directory is resolved: a symlink is
+// then removed or renamed itself, instead of its target.
+func (d DirFS) link(name string) (string, error) {
+	v := path.Clean("/" + name)
+	if v == "/" {
+		return d.real(v)
+	}
+	dir, err := d.real(path.Dir(v))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(v)), nil
+}
+
+func (d DirFS) Open(name string) (File, error) {
+	p, err := d.real(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (d DirFS) Create(name string, flag int) (File, error) {
+	p, err := d.real(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (d DirFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.real(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d DirFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	p, err := d.real(name)
+	if err != nil {
+		return nil, err
+	}
+	xs, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]fs.FileInfo, 0, len(xs))
+	for _, x := range xs {
+		var fi fs.FileInfo
+		if x.Type()&fs.ModeSymlink != 0 {
+			var q string
+			if q, err = d.real(path.Join(name, x.Name())); err == nil {
+				fi, err = os.Stat(q)
+				fi = namedInfo{fi, x.Name()}
+			}
+		} else {
+			fi, err = x.Info()
+		}
+		if err != nil {
+			// e.g. removed in the meantime
+			continue
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+func (d DirFS) Rename(from, to string) error {
+	p, err := d.link(from)
+	if err != nil {
+		return err
+	}
+	q, err := d.link(to)
+	if err != nil {
+		return err
+	}
+	return os.Rename(p, q)
+}
+
+func (d DirFS) Remove(name string) error {
+	p, err := d.link(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d DirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.real(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+// Real paths are unique, once symlinks are resolved.
+func (d DirFS) FileID(name string) (string, error) {
+	return d.real(name)
+}
+
+// A followed symlink: its target's info, under its own name.
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (n namedInfo) Name() string {
+	return n.name
+}
+
+// Sub serves dir, a directory of fsys.
+func Sub(fsys FS, dir string) FS {
+	return subFS{fsys, path.Clean("/" + dir)}
+}
+
+type subFS struct {
+	fsys FS
+	dir  string
+}
+
+func (s subFS) path(name string) string {
+	return path.Join(s.dir, path.Clean("/"+name))
+}
+
+func (s subFS) Open(name string) (File, error) {
+	return s.fsys.Open(s.path(name))
+}
+
+func (s subFS) Create(name string, flag int) (File, error) {
+	return s.fsys.Create(s.path(name), flag)
+}
+
+func (s subFS) Stat(name string) (fs.FileInfo, error) {
+	return s.fsys.Stat(s.path(name))
+}
+
+func (s subFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	return s.fsys.ReadDir(s.path(name))
+}
+
+func (s subFS) Rename(from, to string) error {
+	return s.fsys.Rename(s.path(from), s.path(to))
+}
+
+func (s subFS) Remove(name string) error {
+	return s.fsys.Remove(s.path(name))
+}
+
+func (s subFS) Mkdir(name string, perm fs.FileMode) error {
+	return s.fsys.Mkdir(s.path(name), perm)
+}
+
+func (s subFS) FileID(name string) (string, error) {
+	return fileID(s.fsys, s.path(name))
+}
+
+// ReadOnly serves fsys, e.g. an embed.FS, read-only: what would
+// modify it fails with fs.ErrPermission.
+func ReadOnly(fsys fs.FS) FS {
+	return readOnlyFS{fsys}
+}
+
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+// io/fs names are unrooted, e.g. "a/b", or "." for the root.
+func (r readOnlyFS) path(name string) string {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func (r readOnlyFS) Open(name string) (File, error) {
+	f, err := r.fsys.Open(r.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{f, name}, nil
+}
+
+func (r readOnlyFS) Create(name string, _ int) (File, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+}
+
+func (r readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, r.path(name))
+}
+
+func (r readOnlyFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	xs, err := fs.ReadDir(r.fsys, r.path(name))
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]fs.FileInfo, 0, len(xs))
+	for _, x := range xs {
+		if fi, err := x.Info(); err == nil {
+			fis = append(fis, fi)
+		}
+	}
+	return fis, nil
+}
+
+func (r readOnlyFS) Rename(from, _ string) error {
+	return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrPermission}
+}
+
+func (r readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (r readOnlyFS) Mkdir(name string, _ fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+type readOnlyFile struct {
+	fs.File
+	name string
+}
+
+func (f readOnlyFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f readOnlyFile) Truncate(int64) error {
+	return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
+}
+
+// e.g. for REST; embed.FS's files can seek
+func (f readOnlyFile) Seek(off int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(off, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+// MemFS is an in-memory FS, e.g. for tests; the zero value is an
+// empty filesystem, ready to use.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // by (clean, absolute) name
+}
+
+type memNode struct {
+	dir   bool
+	data  []byte
+	mtime time.Time
+}
+
+func memErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
 )
 
-const (
-	// context key for the data socket
-	dataSock = "data-sock"
-)
+// Looks name up, m.mu held; its parent directory must exist.
+func (m *MemFS) lookup(op, name string) (string, *memNode, error) {
+	if m.nodes == nil {
+		m.nodes = map[string]*memNode{"/": {dir: true, mtime: time.Now()}}
+	}
+	name = path.Clean("/" + name)
+	if d, ok := m.nodes[path.Dir(name)]; !ok || !d.dir {
+		return name, nil, memErr(op, name, fs.ErrNotExist)
+	}
+	return name, m.nodes[name], nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, n, err := m.lookup("open", name)
+	if err == nil && n == nil {
+		err = memErr("open", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{m: m, n: n, name: name}, nil
+}
+
+func (m *MemFS) Create(name string, flag int) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, n, err := m.lookup("create", name)
+	switch {
+	case err != nil:
+		return nil, err
+	case n == nil:
+		n = &memNode{mtime: time.Now()}
+		m.nodes[name] = n
+	case n.dir:
+		return nil, memErr("create", name, errIsDir)
+	case flag&os.O_EXCL != 0:
+		return nil, memErr("create", name, fs.ErrExist)
+	case flag&os.O_TRUNC != 0:
+		n.data, n.mtime = nil, time.Now()
+	}
+	return &memFile{m: m, n: n, name: name, write: true, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, n, err := m.lookup("stat", name)
+	if err == nil && n == nil {
+		err = memErr("stat", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n.info(name), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, n, err := m.lookup("readdir", name)
+	if err == nil && n == nil {
+		err = memErr("readdir", name, fs.ErrNotExist)
+	} else if err == nil && !n.dir {
+		err = memErr("readdir", name, errNotDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fis []fs.FileInfo
+	for p, c := range m.nodes {
+		if p != "/" && path.Dir(p) == name {
+			fis = append(fis, c.info(p))
+		}
+	}
+	slices.SortFunc(fis, func(a, b fs.FileInfo) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return fis, nil
+}
+
+func (m *MemFS) Rename(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, n, err := m.lookup("rename", from)
+	if err == nil && n == nil {
+		err = memErr("rename", from, fs.ErrNotExist)
+	}
+	if err != nil {
+		return err
+	}
+	to, old, err := m.lookup("rename", to)
+	switch {
+	case err != nil:
+		return err
+	case from == "/" || to == "/":
+		return memErr("rename", from, fs.ErrPermission)
+	case to == from:
+		return nil
+	case old != nil && old.dir:
+		return memErr("rename", to, fs.ErrExist)
+	case old != nil && n.dir:
+		return memErr("rename", to, errNotDir)
+	case strings.HasPrefix(to, from+"/"):
+		return memErr("rename", to, fs.ErrInvalid)
+	}
+
+	// a directory's content moves along
+	moved := map[string]*memNode{to: n}
+	for p, c := range m.nodes {
+		if rel, ok := strings.CutPrefix(p, from+"/"); ok {
+			moved[to+"/"+rel] = c
+			delete(m.nodes, p)
+		}
+	}
+	delete(m.nodes, from)
+	maps.Copy(m.nodes, moved)
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, n, err := m.lookup("remove", name)
+	switch {
+	case err != nil:
+		return err
+	case n == nil:
+		return memErr("remove", name, fs.ErrNotExist)
+	case name == "/":
+		return memErr("remove", name, fs.ErrPermission)
+	}
+	for p := range m.nodes {
+		if strings.HasPrefix(p, name+"/") {
+			return memErr("remove", name, errNotEmpty)
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFS) Mkdir(name string, _ fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, n, err := m.lookup("mkdir", name)
+	if err == nil && n != nil {
+		err = memErr("mkdir", name, fs.ErrExist)
+	}
+	if err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{dir: true, mtime: time.Now()}
+	return nil
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	mode := fs.FileMode(0644)
+	if n.dir {
+		mode = fs.ModeDir | 0755
+	}
+	return memInfo{path.Base(name), int64(len(n.data)), mode, n.mtime}
+}
+
+type memInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.mtime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+type memFile struct {
+	m      *MemFS
+	n      *memNode
+	name   string
+	off    int64
+	write  bool
+	append bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.n.dir {
+		return 0, memErr("read", f.name, errIsDir)
+	}
+	if f.off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	k := copy(p, f.n.data[f.off:])
+	f.off += int64(k)
+	return k, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if !f.write {
+		return 0, memErr("write", f.name, fs.ErrPermission)
+	}
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.append {
+		f.off = int64(len(f.n.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.n.data)) {
+		f.n.data = append(f.n.data, make([]byte, end-int64(len(f.n.data)))...)
+	}
+	copy(f.n.data[f.off:], p)
+	f.off += int64(len(p))
+	f.n.mtime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(off int64, whence int) (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		off += f.off
+	case io.SeekEnd:
+		off += int64(len(f.n.data))
+	}
+	if off < 0 {
+		return 0, memErr("seek", f.name, fs.ErrInvalid)
+	}
+	f.off = off
+	return off, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if !f.write {
+		return memErr("truncate", f.name, fs.ErrPermission)
+	}
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if size < 0 {
+		return memErr("truncate", f.name, fs.ErrInvalid)
+	}
+	if size <= int64(len(f.n.data)) {
+		f.n.data = f.n.data[:size]
+	} else {
+		f.n.data = append(f.n.data, make([]byte, size-int64(len(f.n.data)))...)
+	}
+	f.n.mtime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	return f.n.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// Reports err, without leaking real paths; name is what
+// the client asked for.
+func replyErr(conn net.Conn, code int, name string, err error) {
+	var pe *fs.PathError
+	var le *os.LinkError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	} else if errors.As(err, &le) {
+		err = le.Err
+	}
+	msg := []rune(err.Error())
+	if len(msg) > 0 {
+		msg[0] = unicode.ToUpper(msg[0])
+	}
+	if name == "" {
+		name = "."
+	}
+	fmt.Fprintf(conn, "%d %s: %s\r\n", code, name, string(msg))
+}
+
+// TYPE A (the default, as per the RFC) is NVT-ASCII, where lines
+// end with CRLF: local files, with '\n'-terminated lines, are
+// converted back and forth. TYPE I transfers files as-is.
+func isASCII(sess *Session) bool {
+	return sess.typ != "I"
+}
+
+// Converts '\n' to "\r\n" (a "\r\n" is left untouched).
+type toCRLF struct {
+	w  io.Writer
+	cr bool // last byte was a '\r'
+}
+
+func (t *toCRLF) Write(p []byte) (int, error) {
+	q := make([]byte, 0, len(p)+len(p)/32)
+	for _, b := range p {
+		if b == '\n' && !t.cr {
+			q = append(q, '\r')
+		}
+		q = append(q, b)
+		t.cr = b == '\r'
+	}
+	if _, err := t.w.Write(q); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Converts "\r\n" to '\n'; a '\r' ending a Write is held back
+// until we know what follows, hence Flush.
+type fromCRLF struct {
+	w  io.Writer
+	cr bool
+}
+
+func (f *fromCRLF) Write(p []byte) (int, error) {
+	q := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if f.cr && b != '\n' {
+			q = append(q, '\r')
+		}
+		f.cr = b == '\r'
+		if !f.cr {
+			q = append(q, b)
+		}
+	}
+	if _, err := f.w.Write(q); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *fromCRLF) Flush() error {
+	if !f.cr {
+		return nil
+	}
+	f.cr = false
+	_, err := f.w.Write([]byte{'\r'})
+	return err
+}
+
+// Receives the data socket's content into fd, name, which is
+// closed; the account's quota, if any, is enforced.
+func recv(conn net.Conn, fd File, name string, sess *Session) {
+	ascii := isASCII(sess)
+	limits := sess.limits()
+	u, quota := sess.usage, sess.account.Quota
+	startData(conn, sess, 451, newXferEntry(sess, name, true), func(ctx context.Context, sock net.Conn) (int64, error) {
+		w := limit(ctx, fd, limits)
+		if u != nil {
+			w = &quotaWriter{w, u, quota}
+		}
+		if !ascii {
+			return io.Copy(w, sock)
+		}
+		cw := &fromCRLF{w: w}
+		n, err := io.Copy(cw, sock)
+		if err != nil {
+			return n, err
+		}
+		return n, cw.Flush()
+	}, fd.Close)
+}
+
+var errQuota = &codeError{552, "Quota exceeded"}
+
+// Accounts the bytes written in u, failing once they'd exceed
+// quota: room is reserved before writing, so that concurrent
+// uploads can't exceed it either.
+type quotaWriter struct {
+	w     io.Writer
+	u     *quotaUsage
+	quota int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if !q.u.reserve(int64(len(p)), q.quota) {
+		return 0, errQuota
+	}
+	n, err := q.w.Write(p)
+	// what wasn't written is given back
+	q.u.add(int64(n - len(p)))
+	return n, err
+}
+
+// Bytes used in an account's home, for its quota: computed at
+// the first login (see usage()), then kept up to date by uploads
+// and deletions, as long as a session is logged in there.
+type quotaUsage struct {
+	mu   sync.Mutex
+	used int64
+
+	// guarded by Server.usageMu
+	home string // see acquireUsage()
+	refs int    // sessions
+}
+
+// Adds n bytes, unless they'd exceed quota.
+func (u *quotaUsage) reserve(n, quota int64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.used+n > quota {
+		return false
+	}
+	u.used += n
+	return true
+}
+
+// Adds n bytes (e.g. negative, when a file is removed).
+func (u *quotaUsage) add(n int64) {
+	u.mu.Lock()
+	u.used = max(u.used+n, 0)
+	u.mu.Unlock()
+}
+
+// The usage of fsys, an account's home, for a new session; see
+// releaseUsage(). Accounts sharing a home (e.g. "anonymous" and
+// "ftp") share its usage: homes are told apart by the file ID of
+// their root.
+func (srv *Server) acquireUsage(fsys FS) (*quotaUsage, error) {
+	home, err := fileID(fsys, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	srv.usageMu.Lock()
+	defer srv.usageMu.Unlock()
+	u := srv.usages[home]
+	if u == nil {
+		n, err := usage(fsys)
+		if err != nil {
+			return nil, err
+		}
+		u = &quotaUsage{used: n, home: home}
+		srv.usages[home] = u
+	}
+	u.refs++
+	return u, nil
+}
+
+// Ends a session's use of u: it's forgotten with the last one,
+// and computed again on the next login (the files may change in
+// the meantime).
+func (srv *Server) releaseUsage(u *quotaUsage) {
+	srv.usageMu.Lock()
+	defer srv.usageMu.Unlock()
+	if u.refs--; u.refs == 0 {
+		delete(srv.usages, u.home)
+	}
+}
+
+// Total size of the regular files of fsys; a file reachable
+// under several names (symlinks) is counted once.
+func usage(fsys FS) (int64, error) {
+	var n int64
+	seen := make(map[string]bool)
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		fis, err := fsys.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			p := path.Join(dir, fi.Name())
+			id, err := fileID(fsys, p)
+			if err != nil {
+				// e.g. removed in the meantime
+				continue
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			if fi.IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+			} else if fi.Mode().IsRegular() {
+				n += fi.Size()
+			}
+		}
+		return nil
+	}
+	err := walk("/")
+	return n, err
+}
+
+// Whether there's room left for an upload, replacing freed bytes
+// of an existing file; the client is told if not.
+func quotaRoom(conn net.Conn, sess *Session, freed int64) bool {
+	u := sess.usage
+	if u == nil {
+		return true
+	}
+	u.mu.Lock()
+	full := u.used-freed >= sess.account.Quota
+	u.mu.Unlock()
+	if full {
+		fmt.Fprintf(conn, "552 Quota exceeded\r\n")
+		return false
+	}
+	return true
+}
+
+// Checks that v, arg's virtual path, can be created, or replaced:
+// returns its current info, if it exists. Errors are reported to
+// the client (e.g. arg is outside of the root).
+func creatable(conn net.Conn, arg, v string, sess *Session) (fs.FileInfo, bool) {
+	fi, err := sess.fs.Stat(v)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		replyErr(conn, 550, arg, err)
+		return nil, false
+	}
+	return fi, true
+}
+
+// STOR, APPE
+func store(conn net.Conn, fn string, sess *Session, flags int) {
+	if fn == "" {
+		fmt.Fprintf(conn, "501 No file specified\r\n")
+		return
+	}
+	if !hasData(conn, sess) {
+		return
+	}
+
+	v := vpath(fn, sess)
+	fi, ok := creatable(conn, fn, v, sess)
+	if !ok {
+		return
+	}
+
+	// STOR after REST: what's past the offset is overwritten
+	off := sess.rest
+	if flags&os.O_APPEND != 0 {
+		off = 0
+	} else if off > 0 {
+		flags &^= os.O_TRUNC
+	}
+
+	var freed int64
+	if fi != nil && flags&os.O_APPEND == 0 && fi.Mode().IsRegular() {
+		freed = max(fi.Size()-off, 0)
+	}
+	if !quotaRoom(conn, sess, freed) {
+		return
+	}
+
+	fd, err := sess.fs.Create(v, flags)
+	if err != nil {
+		replyErr(conn, 553, fn, err)
+		return
+	}
+	if off > 0 {
+		if !restart(conn, fd, fn, sess) {
+			fd.Close()
+			return
+		}
+		if err := fd.Truncate(off); err != nil {
+			fd.Close()
+			replyErr(conn, 451, fn, err)
+			return
+		}
+	}
+	if sess.usage != nil {
+		sess.usage.add(-freed)
+	}
+
+	fmt.Fprintf(conn, "150 Opening data connection\r\n")
+	recv(conn, fd, v, sess)
+}
+
+func stor(conn net.Conn, fn string, sess *Session) {
+	store(conn, fn, sess, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+func appe(conn net.Conn, fn string, sess *Session) {
+	store(conn, fn, sess, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+}
+
+// Stores under a unique name, in the working directory; the
+// argument, if any, is used as a prefix.
+func stou(conn net.Conn, prefix string, sess *Session) {
+	if !hasData(conn, sess) {
+		return
+	}
+	if prefix == "" {
+		prefix = "stou"
+	}
+
+	if !quotaRoom(conn, sess, 0) {
+		return
+	}
+
+	// as os.CreateTemp
+	var fd File
+	var v string
+	var err error
+	for range 10000 {
+		v = path.Join(sess.wd, path.Base(prefix)+"."+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		fd, err = sess.fs.Create(v, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		replyErr(conn, 553, "", err)
+		return
+	}
+
+	// RFC 1123, 4.1.2.9
+	fmt.Fprintf(conn, "150 FILE: %s\r\n", path.Base(v))
+	recv(conn, fd, v, sess)
+}
+
+// Virtual path for arg, which can't be the root itself, e.g.
+// for RMD or RNFR; errors are reported to the client.
+func inside(conn net.Conn, arg string, sess *Session) (string, bool) {
+	v := vpath(arg, sess)
+	if v == "/" {
+		replyErr(conn, 550, arg, errJail)
+		return "", false
+	}
+	return v, true
+}
+
+func dele(conn net.Conn, fn string, sess *Session) {
+	v, ok := inside(conn, fn, sess)
+	if !ok {
+		return
+	}
+	fi, err := sess.fs.Stat(v)
+	if err != nil {
+		replyErr(conn, 550, fn, err)
+		return
+	}
+	if fi.IsDir() {
+		fmt.Fprintf(conn, "550 %s: Is a directory\r\n", fn)
+		return
+	}
+	if err := sess.fs.Remove(v); err != nil {
+		replyErr(conn, 550, fn, err)
+		return
+	}
+	if sess.usage != nil && fi.Mode().IsRegular() {
+		sess.usage.add(-fi.Size())
+	}
+	fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
+}
+
+func mkd(conn net.Conn, dn string, sess *Session) {
+	if dn == "" {
+		fmt.Fprintf(conn, "501 No directory specified\r\n")
+		return
+	}
+	v := vpath(dn, sess)
+	if err := sess.fs.Mkdir(v, 0755); err != nil {
+		replyErr(conn, 550, dn, err)
+		return
+	}
+	// quotes are doubled (RFC 959, appendix II)
+	fmt.Fprintf(conn, "257 \"%s\" created\r\n", strings.ReplaceAll(v, `"`, `""`))
+}
+
+func rmd(conn net.Conn, dn string, sess *Session) {
+	v, ok := inside(conn, dn, sess)
+	if !ok {
+		return
+	}
+	fi, err := sess.fs.Stat(v)
+	if err != nil {
+		replyErr(conn, 550, dn, err)
+		return
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(conn, "550 %s: Not a directory\r\n", dn)
+		return
+	}
+	if err := sess.fs.Remove(v); err != nil {
+		replyErr(conn, 550, dn, err)
+		return
+	}
+	fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
+}
+
+func rnfr(conn net.Conn, fn string, sess *Session) {
+	v, ok := inside(conn, fn, sess)
+	if !ok {
+		return
+	}
+	if _, err := sess.fs.Stat(v); err != nil {
+		replyErr(conn, 550, fn, err)
+		return
+	}
+	sess.rnfr = v
+	fmt.Fprintf(conn, "350 ready for RNTO\r\n")
+}
+
+func rnto(conn net.Conn, fn string, sess *Session) {
+	from := sess.rnfr
+	if from == "" {
+		fmt.Fprintf(conn, "503 RNFR first\r\n")
+		return
+	}
+	sess.rnfr = ""
+
+	if fn == "" {
+		fmt.Fprintf(conn, "501 No file specified\r\n")
+		return
+	}
+	v, ok := inside(conn, fn, sess)
+	if !ok {
+		return
+	}
+	fi, ok := creatable(conn, fn, v, sess)
+	if !ok {
+		return
+	}
+	if err := sess.fs.Rename(from, v); err != nil {
+		replyErr(conn, 553, fn, err)
+		return
+	}
+	// a replaced file frees its size, as with DELE
+	if sess.usage != nil && fi != nil && fi.Mode().IsRegular() && v != from {
+		sess.usage.add(-fi.Size())
+	}
+	fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
+}
 
-func endData(conn, sock net.Conn, ctx map[string]any) {
-	err := sock.Close()
-	delete(ctx, dataSock)
+// Writer counting what's written.
+type counter int64
 
-	// at least log it
+func (c *counter) Write(p []byte) (int, error) {
+	*c += counter(len(p))
+	return len(p), nil
+}
+
+// As per RFC 3659, the size is the number of bytes a RETR would
+// transfer, so it depends on TYPE.
+func size(conn net.Conn, fn string, sess *Session) {
+	v := vpath(fn, sess)
+	fi, err := sess.fs.Stat(v)
 	if err != nil {
-		log.Println("error: failed to close socket: %s\r\n", err)
+		replyErr(conn, 550, fn, err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		fmt.Fprintf(conn, "550 %s: Not a regular file\r\n", fn)
+		return
 	}
 
-	fmt.Fprintf(conn, "250 transfer complete\r\n")
-}
+	n := fi.Size()
+	if isASCII(sess) {
+		fd, err := sess.fs.Open(v)
+		if err != nil {
+			replyErr(conn, 550, fn, err)
+			return
+		}
+		defer fd.Close()
 
-// TODO: support LIST <arg>
-func list(conn net.Conn, arg string, ctx map[string]any) {
-	// would be better to test those !ok
-	isock, _ := ctx[dataSock]
-	sock, _ := isock.(net.Conn)
-	iwd, _ := ctx["wd"]
-	wd, _ := iwd.(string)
+		var c counter
+		if _, err := io.Copy(&toCRLF{w: &c}, fd); err != nil {
+			replyErr(conn, 550, fn, err)
+			return
+		}
+		n = int64(c)
+	}
+	fmt.Fprintf(conn, "213 %d\r\n", n)
+}
 
-	xs, err := os.ReadDir(wd)
+func mdtm(conn net.Conn, fn string, sess *Session) {
+	fi, err := sess.fs.Stat(vpath(fn, sess))
 	if err != nil {
-		fmt.Fprintf(conn, "500 internal error: failed to open '%s': %s\r\n", err)
+		replyErr(conn, 550, fn, err)
 		return
 	}
+	// YYYYMMDDHHMMSS, in UTC (RFC 3659, 2.3)
+	fmt.Fprintf(conn, "213 %s\r\n", fi.ModTime().UTC().Format("20060102150405"))
+}
 
-	_, err = fmt.Fprintf(conn, "125 Data connection already open; transfer starting\r\n")
+func noop(conn net.Conn, _ string, sess *Session) {
+	fmt.Fprintf(conn, "200 OK\r\n")
+}
 
-	if err != nil {
-		log.Println(err)
+// TYPE A [N] and I (or L 8) only: no EBCDIC, no Telnet or
+// ASA format controls.
+func typ(conn net.Conn, arg string, sess *Session) {
+	switch strings.Join(strings.Fields(strings.ToUpper(arg)), " ") {
+	case "A", "A N":
+		sess.typ = "A"
+	case "I", "L 8":
+		sess.typ = "I"
+	case "A T", "A C", "E", "E N", "E T", "E C", "L":
+		fmt.Fprintf(conn, "504 TYPE %s not implemented\r\n", arg)
+		return
+	default:
+		fmt.Fprintf(conn, "501 unexpected TYPE %s\r\n", arg)
 		return
 	}
-	for _, x := range xs {
-		_, err := fmt.Fprintf(sock, "%s\r\n", x.Name())
-		if err != nil {
-			fmt.Fprintf(conn, "500 failed to write filename '%s': %s\r\n", x.Name(), err)
-			return
+	fmt.Fprintf(conn, "200 TYPE set to %s\r\n", sess.typ)
+}
+
+// Only stream mode
+func mode(conn net.Conn, arg string, sess *Session) {
+	switch strings.ToUpper(arg) {
+	case "S":
+		fmt.Fprintf(conn, "200 MODE set to S\r\n")
+	case "B", "C":
+		fmt.Fprintf(conn, "504 MODE %s not implemented\r\n", arg)
+	default:
+		fmt.Fprintf(conn, "501 unexpected MODE %s\r\n", arg)
+	}
+}
+
+// Only file structure
+func stru(conn net.Conn, arg string, sess *Session) {
+	switch strings.ToUpper(arg) {
+	case "F":
+		fmt.Fprintf(conn, "200 STRU set to F\r\n")
+	case "R", "P":
+		fmt.Fprintf(conn, "504 STRU %s not implemented\r\n", arg)
+	default:
+		fmt.Fprintf(conn, "501 unexpected STRU %s\r\n", arg)
+	}
+}
+
+var cmds = map[string](func(net.Conn, string, *Session) ){
+	"LIST" : list,
+	"NLST" : nlst,
+	"MLSD" : mlsd,
+	"MLST" : mlst,
+	"FEAT" : feat,
+	"OPTS" : opts,
+	"RETR" : retr,
+	"CWD"  : cwd,
+	"XCWD" : cwd,
+	"CDUP" : cdup,
+	"XCUP" : cdup,
+	"USER" : user,
+	"PASS" : pass,
+	"AUTH" : authTLS,
+	"PBSZ" : pbsz,
+	"PROT" : prot,
+	"REST" : rest,
+	"ABOR" : abor,
+	"SYST" : syst,
+	"PWD"  : pwd,
+	"XPWD" : pwd,
+	"QUIT" : quit,
+	"PORT" : port,
+	"EPRT" : eprt,
+	"PASV" : pasv,
+	"EPSV" : epsv,
+	"STOR" : stor,
+	"APPE" : appe,
+	"STOU" : stou,
+	"DELE" : dele,
+	"MKD"  : mkd,
+	"XMKD" : mkd,
+	"RMD"  : rmd,
+	"XRMD" : rmd,
+	"RNFR" : rnfr,
+	"RNTO" : rnto,
+	"SIZE" : size,
+	"MDTM" : mdtm,
+	"NOOP" : noop,
+	"TYPE" : typ,
+	"MODE" : mode,
+	"STRU" : stru,
+}
+
+// Records the code of the last reply written, for the access log.
+type replyConn struct {
+	net.Conn
+	code atomic.Int32
+}
+
+func (c *replyConn) Write(p []byte) (int, error) {
+	// "NNN text", or "NNN-text" for multi-line replies
+	if len(p) >= 3 {
+		if n, err := strconv.Atoi(string(p[:3])); err == nil {
+			c.code.Store(int32(n))
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// A Server serves FTP sessions, from one or more listeners; its
+// settings mustn't be changed once Serve has been called.
+type Server struct {
+	// Maximum number of simultaneous sessions (0: no limit);
+	// clients over the limit are told 421, and disconnected.
+	MaxConns int
+
+	// Sessions idle for that long, i.e. without commands nor
+	// transfers, are told 421 and closed (0: no timeout).
+	IdleTimeout time.Duration
+
+	// Access log: a record per connection, command, transfer,
+	// and disconnection (none if nil).
+	Log *slog.Logger
+
+	// Transfer log, in the xferlog format: a line per RETR or
+	// STOR (APPE, STOU), once over (none if nil).
+	Xferlog io.Writer
+
+	// Bandwidth limits, in bytes per second, for all the
+	// transfers and per session (0: no limit).
+	Rate        int64
+	SessionRate int64
+
+	// What's served, accounts' homes being directories of it;
+	// DirFS(Root) if nil.
+	FS FS
+
+	// Directory served, as "/", unless FS is set; relative
+	// homes are in it ("" is the current directory).
+	Root string
+
+	// Authentication backend (Anonymous{} if nil).
+	Auth Authenticator
+
+	// FTPS (RFC 4217) settings: no AUTH if TLSConfig is nil;
+	// TLSRequired for logins and data connections.
+	TLSConfig   *tls.Config
+	TLSRequired bool
+
+	// Range of passive ports to listen on (0, 0 for any), and
+	// address given to clients, e.g. the public address of a
+	// NAT ("" for the control connection's).
+	PasvMin, PasvMax int
+	PasvAddr         string
+
+	// Past MaxFailures failed logins from an IP within
+	// FailWindow, it's refused further attempts (5 and 10
+	// minutes if 0).
+	MaxFailures int
+	FailWindow  time.Duration
+
+	once     sync.Once
+	mu       sync.Mutex
+	lns      map[net.Listener]bool
+	sessions map[*Session]bool
+	lastID   uint64
+	closing  atomic.Bool
+	wg       sync.WaitGroup
+	xlMu     sync.Mutex
+	rate     *bucket
+	failures loginFailures
+
+	// per home, for quotas (see acquireUsage())
+	usageMu sync.Mutex
+	usages  map[string]*quotaUsage
+
+	// cancelled when Shutdown gives up: transfers are aborted
+	kill    context.Context
+	killAll context.CancelFunc
+}
+
+// acc's home, served as "/".
+func (srv *Server) home(acc *Account) (FS, error) {
+	var fsys FS
+	if srv.FS != nil {
+		fsys = Sub(srv.FS, acc.Home)
+	} else {
+		home := acc.Home
+		if !filepath.IsAbs(home) {
+			home = filepath.Join(srv.Root, home)
 		}
+		fsys = DirFS(home)
 	}
 
-	endData(conn, sock, ctx)
+	fi, err := fsys.Stat("/")
+	if err == nil && !fi.IsDir() {
+		err = errNotDir
+	}
+	return fsys, err
 }
 
-func pwd(conn net.Conn, _ string, ctx map[string]any) {
-	iwd, _ := ctx["wd"]
-	wd, _ := iwd.(string)
-	fmt.Fprintf(conn, "257 \"%s\" is current directory\r\n", wd)
+// Returned by Serve, once Shutdown has been called.
+var ErrServerClosed = errors.New("ftpd: Server closed")
+
+func (srv *Server) init() {
+	srv.once.Do(func() {
+		srv.lns = make(map[net.Listener]bool)
+		srv.sessions = make(map[*Session]bool)
+		srv.usages = make(map[string]*quotaUsage)
+		srv.kill, srv.killAll = context.WithCancel(context.Background())
+		srv.rate = newBucket(srv.Rate)
+		srv.failures = loginFailures{
+			ips:    make(map[string][]time.Time),
+			max:    cmp.Or(srv.MaxFailures, 5),
+			window: cmp.Or(srv.FailWindow, 10*time.Minute),
+		}
+	})
 }
 
-func retr(conn net.Conn, fn string, ctx map[string]any) {
-	if fn == "" {
-		fmt.Fprintf(conn, "501 No file specified")
-		return
+func (srv *Server) auth() Authenticator {
+	if srv.Auth == nil {
+		return Anonymous{}
 	}
+	return srv.Auth
+}
 
-	// would be better to test those !ok
-	isock, _ := ctx[dataSock]
-	sock, _ := isock.(net.Conn)
-	iwd, _ := ctx["wd"]
-	wd, _ := iwd.(string)
+// Serve accepts connections from ln, each served in its own
+// goroutine, until Shutdown is called. ln is closed on return.
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.init()
 
-	_, err := fmt.Fprintf(conn, "125 Data connection already open; transfer starting\r\n")
+	srv.mu.Lock()
+	if srv.closing.Load() {
+		srv.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	srv.lns[ln] = true
+	srv.mu.Unlock()
 
-	fd, err := os.Open(filepath.Join(wd, fn))
-	if err != nil {
-		fmt.Fprintf(conn, "550 failed: %s\r\n", err)
-		return
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.lns, ln)
+		srv.mu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if srv.closing.Load() {
+			if err == nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			// e.g. connection aborted, too many open files
+			log.Print(err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		srv.start(conn)
 	}
+}
 
-	if _, err := io.Copy(sock, fd); err != nil {
-		fmt.Fprintf(conn, "500 failed: %s\r\n", err)
+func (srv *Server) start(conn net.Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing.Load() {
+		conn.Close()
 		return
 	}
-
-	if err != nil {
-		log.Println(err)
+	if srv.MaxConns > 0 && len(srv.sessions) >= srv.MaxConns {
+		srv.logger().Info("rejected", "remote", conn.RemoteAddr().String(), "code", 421)
+		// the write may block (e.g. implicit TLS handshake)
+		go func() {
+			conn.SetDeadline(time.Now().Add(dataTimeout))
+			fmt.Fprintf(conn, "421 Too many connections, try again later\r\n")
+			conn.Close()
+		}()
 		return
 	}
 
-	endData(conn, sock, ctx)
+	srv.lastID++
+	sess := &Session{
+		srv:  srv,
+		id:   srv.lastID,
+		raw:  conn,
+		conn: &replyConn{Conn: conn},
+		r:    bufio.NewReader(conn),
+		wd:   "/",
+		typ:  "A",
+		mlst: mlstFacts,
+		rate: newBucket(srv.SessionRate),
+	}
+	srv.sessions[sess] = true
+	srv.wg.Add(1)
+
+	go func() {
+		defer srv.wg.Done()
+		sess.serve()
+		sess.logout()
+
+		srv.mu.Lock()
+		delete(srv.sessions, sess)
+		srv.mu.Unlock()
+	}()
 }
 
-func cwd(conn net.Conn, arg string, ctx map[string]any) {
-	if arg == "" {
-		fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
-		return
+// Shutdown stops accepting connections, and closes the sessions
+// as soon as they're idle, i.e. once their transfer, if any, is
+// over (421). If ctx expires first, the remaining sessions are
+// closed, their transfers aborted, and ctx's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.init()
+
+	srv.mu.Lock()
+	srv.closing.Store(true)
+	for ln := range srv.lns {
+		ln.Close()
+	}
+	// interrupts the commands' reads (see readCommand())
+	for sess := range srv.sessions {
+		sess.raw.SetReadDeadline(time.Now())
 	}
+	srv.mu.Unlock()
 
-	if arg[0] == '/' {
-		ctx["wd"] = arg
-	} else {
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
 
-		iwd, _ := ctx["wd"]
-		wd, _ := iwd.(string)
-		wd = filepath.Join(wd, arg)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
 
-		fi, err := os.Stat(wd)
-		if err != nil {
-			fmt.Fprintf(conn, "500 failed: %s\r\n", err)
-			return
+	srv.killAll()
+	srv.mu.Lock()
+	for sess := range srv.sessions {
+		sess.raw.Close()
+	}
+	srv.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// Writes an xferlog line, e.g.
+//
+//	Mon Oct 19 17:54:57 2026 1 127.0.0.1 5 /srv/ftp/f b _ i a me@example.com ftp 0 * c
+//
+// i.e. the current time, the transfer's duration (seconds), the
+// remote host, the number of bytes, the file, the type (a: ASCII,
+// b: binary), special actions (_: none), the direction (o: RETR,
+// i: STOR), the access mode (a: anonymous, r: real user), the
+// user name (the e-mail address given, if anonymous), the
+// service, the authentication method (0: none), the authenticated
+// user ID (*: none), and the completion status (c: complete,
+// i: incomplete).
+func (srv *Server) xferlog(e *xferEntry, start time.Time, n int64, complete bool) {
+	if srv.Xferlog == nil {
+		return
+	}
+
+	// one field each
+	field := func(s string) string {
+		if s == "" {
+			return "*"
 		}
-		if !fi.IsDir() {
-			fmt.Fprintf(conn, "500 failed: %s is not a directory\r\n", wd)
-			return
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) || unicode.IsControl(r) {
+				return '_'
+			}
+			return r
+		}, s)
+	}
+	pick := func(b bool, t, f string) string {
+		if b {
+			return t
 		}
-		ctx["wd"] = wd
+		return f
 	}
 
-	fmt.Fprintf(conn, "250 requested file action okay, completed\r\n")
+	user := e.account.Name
+	if e.account.Anonymous {
+		user = e.account.Email
+	}
+	line := fmt.Sprintf("%s %d %s %d %s %s _ %s %s %s ftp 0 * %s\n",
+		time.Now().Format("Mon Jan _2 15:04:05 2006"),
+		int64(math.Round(time.Since(start).Seconds())),
+		e.host, n, field(e.file),
+		pick(e.ascii, "a", "b"),
+		pick(e.incoming, "i", "o"),
+		pick(e.account.Anonymous, "a", "r"),
+		field(user),
+		pick(complete, "c", "i"))
+
+	srv.xlMu.Lock()
+	defer srv.xlMu.Unlock()
+	if _, err := io.WriteString(srv.Xferlog, line); err != nil {
+		log.Println("xferlog:", err)
+	}
 }
 
-func user(conn net.Conn, user string, ctx map[string]any) {
-	ctx["user"] = user
-	fmt.Fprintf(conn, "230 Login successful\r\n")
+// A token bucket: rate bytes per second on average, with bursts
+// of up to a second's worth; nil means no limit.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
 }
 
-func syst(conn net.Conn, _ string, ctx map[string]any) {
-	fmt.Fprintf(conn, "215 ftpd.go\r\n")
+func newBucket(rate int64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
 }
 
-func quit(conn net.Conn, _ string, ctx map[string]any) {
-	conn.Close()
+// Largest chunk to wait for at once.
+func (b *bucket) burst() int {
+	return int(min(b.rate, 32*1024))
 }
 
-func port(conn net.Conn, args string, ctx map[string]any) {
-	xs := strings.Split(args, ",")
-	if len(xs) != 6 {
-		fmt.Fprintf(conn, "500 unexpected PORT value %s\r\n", args)
-		return
+// Takes n tokens, waiting for them if needed (the bucket may go
+// into debt, so that n can be more than its size); returns early,
+// with ctx's error, if ctx is done.
+func (b *bucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	d := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	ip := strings.Join(xs[0:4], ".")
+// The bandwidth limits of a transfer: global, and per session.
+func (sess *Session) limits() []*bucket {
+	var bs []*bucket
+	for _, b := range []*bucket{sess.srv.rate, sess.rate} {
+		if b != nil {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
 
-	ph, err := strconv.Atoi(xs[4])
-	if err != nil {
-		fmt.Fprintf(conn, "500 %s is not an integer %s\r\n", xs[4])
-		return
+// w, as fast as the buckets allow.
+func limit(ctx context.Context, w io.Writer, bs []*bucket) io.Writer {
+	if len(bs) == 0 {
+		// e.g. io.Copy() can then use sendfile(2)
+		return w
 	}
-	pl, err := strconv.Atoi(xs[5])
-	if err != nil {
-		fmt.Fprintf(conn, "500 %s is not an integer %s\r\n", xs[5])
-		return
+	return &limitedWriter{ctx, w, bs}
+}
+
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	bs  []*bucket
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := len(p)
+		for _, b := range l.bs {
+			k = min(k, b.burst())
+		}
+		for _, b := range l.bs {
+			if err := b.wait(l.ctx, k); err != nil {
+				return n, err
+			}
+		}
+		m, err := l.w.Write(p[:k])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
 	}
+	return n, nil
+}
 
-	port := ph * 256 + pl
-	println(port)
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
 
-	c, err := net.Dial("tcp", xs[1]+":"+strconv.Itoa(port))
-	if err != nil {
-		fmt.Fprintf(conn, "425 failed to reach %s:%d: %s\r\n", ip, port, err)
-		fmt.Println(err)
-		return
+func (srv *Server) logger() *slog.Logger {
+	if srv.Log == nil {
+		return discard
+	}
+	return srv.Log
+}
+
+// Access log, with the session's details.
+func (sess *Session) logger() *slog.Logger {
+	user := ""
+	if sess.account != nil {
+		user = sess.account.Name
 	}
-	ctx[dataSock] = c
+	return sess.srv.logger().With(
+		"session", sess.id,
+		"remote", sess.raw.RemoteAddr().String(),
+		"user", user,
+	)
+}
+
+// Reads the next command line. Idle sessions are closed, and so
+// are all the sessions on shutdown, once their transfer (if any)
+// is over; false is returned then, or on errors.
+func (sess *Session) readCommand() (string, bool) {
+	var line string
+	for {
+		var deadline time.Time
+		if sess.srv.IdleTimeout > 0 {
+			deadline = time.Now().Add(sess.srv.IdleTimeout)
+		}
+		sess.raw.SetReadDeadline(deadline)
+
+		// checked after the deadline is set, as Shutdown
+		// sets it too
+		if sess.srv.closing.Load() {
+			waitData(sess)
+			fmt.Fprintf(sess.conn, "421 Server shutting down, closing control connection\r\n")
+			return "", false
+		}
+
+		s, err := sess.r.ReadString('\n')
+		line += s
+		if err == nil {
+			return line, true
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return "", false
+		}
 
-	fmt.Fprintf(conn, "225 listening on %s:%d\r\n", ip, port)
+		// shutting down, or still busy: not idle
+		if sess.srv.closing.Load() || sess.busy() {
+			continue
+		}
+		fmt.Fprintf(sess.conn, "421 Timeout, closing control connection\r\n")
+		sess.logger().Info("timeout", "code", 421)
+		return "", false
+	}
 }
 
-var cmds = map[string](func(net.Conn, string, map[string]any) ){
-	"LIST" : list,
-	"RETR" : retr,
-	"CWD"  : cwd,
-	"USER" : user,
-	"SYST" : syst,
-	"PWD"  : pwd,
-	"XPWD" : pwd,
-	"QUIT" : quit,
-	"PORT" : port,
+// Whether a transfer is running.
+func (sess *Session) busy() bool {
+	if sess.xfer == nil {
+		return false
+	}
+	select {
+	case <-sess.xfer.done:
+		return false
+	default:
+		return true
+	}
 }
 
-func serve(conn net.Conn) {
-	defer conn.Close()
+func (sess *Session) serve() {
+	// conn may be upgraded to TLS
+	defer func() { sess.conn.Close() }()
+	defer closeData(sess)
+
+	// implicit TLS: everything is protected from the start
+	if c, ok := sess.raw.(*tls.Conn); ok {
+		if err := sess.handshake(c); err != nil {
+			log.Println(err)
+			return
+		}
+		sess.tls, sess.pbsz, sess.prot = true, true, "P"
+	}
 
-	r := bufio.NewReader(conn)
+	sess.logger().Info("connect", "tls", sess.tls)
+	defer func() { sess.logger().Info("disconnect") }()
 
 	// say hello
-	_, err := fmt.Fprintf(conn, "200 OK\r\n")
+	_, err := fmt.Fprintf(sess.conn, "220 Service ready\r\n")
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// To store user, data socket, working directory
-	ctx := make(map[string]any)
-
-	ctx["wd"] = "."
-
 	for {
-		s, err := r.ReadString('\n')
-		// could be finer
-		if err != nil {
-			log.Println(err)
+		s, ok := sess.readCommand()
+		if !ok {
 			return
 		}
 		s = strings.TrimRight(s, "\r\n")
-		println(s)
+
+		// Telnet "interrupt process" and "synch", as sent
+		// before ABOR
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "\xff\xf4"), "\xff\xf2")
 
 		xs := strings.SplitN(s, " ", 2)
-		cmd, ok := cmds[xs[0]]
+		name := strings.ToUpper(xs[0])
+		if len(xs) == 1 {
+			xs = append(xs, "")
+		}
+
+		// one command at a time, but for ABOR
+		if name != "ABOR" {
+			waitData(sess)
+		}
+
+		start := time.Now()
+		rc := sess.conn.(*replyConn)
+		rc.code.Store(0)
+
+		cmd, ok := cmds[name]
 		if !ok {
-			_, err := fmt.Fprintf(conn, "502 Command not implemented\r\n")
+			_, err := fmt.Fprintf(sess.conn, "502 Command not implemented\r\n")
 			if err != nil {
 				log.Println(err)
 				return
 			}
-		} else {
-			if len(xs) == 1 {
-				xs = append(xs, "")
+		} else if allowed(sess.conn, name, sess) {
+			cmd(sess.conn, xs[1], sess)
+		}
+
+		arg := xs[1]
+		if name == "PASS" {
+			arg = "****"
+		}
+		sess.logger().Info("command", "cmd", name, "arg", arg,
+			"code", rc.code.Load(), "duration", time.Since(start))
+
+		// REST only applies to the next command
+		if name != "REST" {
+			sess.rest = 0
+		}
+
+		if sess.upgrade {
+			sess.upgrade = false
+			// anything sent after AUTH, before the handshake,
+			// would have been sent in clear (and possibly
+			// injected by a third party).
+			if sess.r.Buffered() > 0 {
+				log.Println("data received before the TLS handshake")
+				return
+			}
+			c := tls.Server(sess.raw, sess.srv.TLSConfig)
+			if err := sess.handshake(c); err != nil {
+				log.Println(err)
+				return
 			}
-			cmd(conn, xs[1], ctx)
+			sess.conn, sess.r = &replyConn{Conn: c}, bufio.NewReader(c)
+			sess.tls = true
 		}
 	}
 }
 
+// Performs c's handshake on the control connection: as with
+// protect(), a client has dataTimeout (or the idle timeout, if
+// shorter) to complete it, instead of holding the session.
+func (sess *Session) handshake(c *tls.Conn) error {
+	d := dataTimeout
+	if t := sess.srv.IdleTimeout; t > 0 {
+		d = min(d, t)
+	}
+	c.SetDeadline(time.Now().Add(d))
+	if err := c.HandshakeContext(sess.srv.kill); err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
 func main() {
-	var port string
+	var port, pasvPorts, htpasswd string
+	var certFile, keyFile, implicitPort string
+	var anonymous, anonymousWrite bool
+	var accessLog, xferlog, rate, sessionRate, anonymousQuota string
+	var shutdownTimeout time.Duration
+	srv := &Server{}
 
-//	flag.StringVar(&root, "root", ".",     "root directory")
+	flag.StringVar(&srv.Root, "root", ".",     "root directory")
 	flag.StringVar(&port, "port", ":8000", "listening port")
+	flag.StringVar(&pasvPorts, "pasv-ports", "", "passive mode port range, e.g. 50000-50100 (default: any)")
+	flag.StringVar(&srv.PasvAddr, "pasv-addr", "", "IPv4 address advertised in passive mode (default: the server's)")
+	flag.StringVar(&htpasswd, "htpasswd", "", "users file (user:bcrypt-hash[:home[:r|rw[:quota]]])")
+	flag.BoolVar(&anonymous, "anonymous", false, "allow anonymous logins, read-only (default if no -htpasswd)")
+	flag.BoolVar(&anonymousWrite, "anonymous-write", false, "allow anonymous uploads")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate (PEM), for FTPS")
+	flag.StringVar(&keyFile, "key", "", "TLS private key (PEM), for FTPS")
+	flag.StringVar(&implicitPort, "implicit-port", "", "implicit FTPS listening port, e.g. :990 (requires -cert, -key)")
+	flag.BoolVar(&srv.TLSRequired, "tls-required", false, "refuse cleartext logins and data connections")
+	flag.IntVar(&srv.MaxConns, "max-conns", 100, "maximum number of simultaneous sessions (0: no limit)")
+	flag.DurationVar(&srv.IdleTimeout, "idle-timeout", 5*time.Minute, "idle sessions timeout (0: none)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "on SIGTERM, how long to wait for transfers to end")
+	flag.StringVar(&accessLog, "access-log", "-", "access log file, as JSON lines (-: stderr, empty: none)")
+	flag.StringVar(&xferlog, "xferlog", "", "transfer log file, in the xferlog format")
+	flag.StringVar(&rate, "rate", "", "bandwidth limit for all transfers, in bytes per second, e.g. 10M")
+	flag.StringVar(&sessionRate, "session-rate", "", "bandwidth limit per session, in bytes per second, e.g. 1M")
+	flag.StringVar(&anonymousQuota, "anonymous-quota", "", "anonymous upload quota, e.g. 100M")
 	flag.Parse()
 
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	if srv.TLSConfig == nil && (implicitPort != "" || srv.TLSRequired) {
+		log.Fatal("FTPS requires -cert and -key")
+	}
+
+	var as Authenticators
+	if htpasswd != "" {
+		h, err := LoadHtpasswd(htpasswd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		as = append(as, h)
+	}
+	if anonymous || anonymousWrite || htpasswd == "" {
+		a := Anonymous{Write: anonymousWrite}
+		if anonymousQuota != "" {
+			var err error
+			if a.Quota, err = parseSize(anonymousQuota); err != nil {
+				log.Fatal(err)
+			}
+		}
+		as = append(as, a)
+	}
+	srv.Auth = as
+
+	if fi, err := os.Stat(srv.Root); err != nil || !fi.IsDir() {
+		log.Fatalf("invalid root directory '%s'", srv.Root)
+	}
+	if pasvPorts != "" {
+		_, err := fmt.Sscanf(pasvPorts, "%d-%d", &srv.PasvMin, &srv.PasvMax)
+		if err != nil || srv.PasvMin <= 0 || srv.PasvMax < srv.PasvMin || srv.PasvMax > 65535 {
+			log.Fatalf("invalid passive port range '%s'", pasvPorts)
+		}
+	}
+	if srv.PasvAddr != "" && net.ParseIP(srv.PasvAddr).To4() == nil {
+		log.Fatalf("invalid passive address '%s': not an IPv4 address", srv.PasvAddr)
+	}
+
+	switch accessLog {
+	case "":
+	case "-":
+		srv.Log = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	default:
+		fd, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		srv.Log = slog.New(slog.NewJSONHandler(fd, nil))
+	}
+
+	for _, x := range []struct {
+		s string
+		n *int64
+	}{{rate, &srv.Rate}, {sessionRate, &srv.SessionRate}} {
+		if x.s == "" {
+			continue
+		}
+		var err error
+		if *x.n, err = parseSize(x.s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if xferlog != "" {
+		fd, err := os.OpenFile(xferlog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		srv.Xferlog = fd
+	}
+
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatal(err)
@@ -271,13 +3227,33 @@ func main() {
 
 	log.Println("Listening on "+port)
 
-	for {
-		conn, err := lis.Accept()
-		log.Println(conn)
+	errs := make(chan error, 2)
+	go func() { errs <- srv.Serve(lis) }()
+
+	if implicitPort != "" {
+		ilis, err := net.Listen("tcp", implicitPort)
 		if err != nil {
-			log.Print(err) // e.g., connection aborted
-			continue
+			log.Fatal(err)
 		}
-		go serve(conn)
+		log.Println("Listening on "+implicitPort+" (implicit FTPS)")
+		go func() { errs <- srv.Serve(tls.NewListener(ilis, srv.TLSConfig)) }()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// a second signal kills us
+	stop()
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Transfers aborted:", err)
 	}
 }
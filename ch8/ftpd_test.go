@@ -0,0 +1,1692 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Serves the current directory, on a random port of addr
+// (127.0.0.1 by default).
+func startServer(t *testing.T, addr ...string) string {
+	host := "127.0.0.1"
+	if len(addr) > 0 {
+		host = addr[0]
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("can't listen on %s: %s", host, err)
+	}
+	serveAll(t, &Server{}, ln)
+	return ln.Addr().String()
+}
+
+// Serves ln's connections until the end of the test, which
+// waits for all of them to be over. Anonymous users have full
+// access unless srv.Auth is set: most tests need it.
+func serveAll(t *testing.T, srv *Server, ln net.Listener) {
+	if srv.Auth == nil {
+		srv.Auth = Anonymous{Write: true}
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %s", err)
+		}
+	})
+}
+
+// A minimal FTP client.
+type client struct {
+	*textproto.Conn
+	t    *testing.T
+	conn net.Conn
+
+	// how to open data connections: PORT, EPRT, PASV or EPSV
+	mode string
+
+	// TLS client settings, once AUTH TLS is done; data
+	// connections are protected too.
+	tls *tls.Config
+
+	// REST offset for the next stor()/retr(), if not 0
+	rest int64
+}
+
+// Connects and logs in, anonymously.
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	c := dialNoLogin(t, addr)
+	c.cmd(331, "USER anonymous")
+	c.cmd(230, "PASS test@example.com")
+	return c
+}
+
+func dialNoLogin(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClient(t, conn)
+}
+
+func newClient(t *testing.T, conn net.Conn) *client {
+	t.Cleanup(func() { conn.Close() })
+
+	c := &client{textproto.NewConn(conn), t, conn, "PORT", nil, 0}
+	c.expect(220)
+	return c
+}
+
+// AUTH TLS, PBSZ 0 and PROT P.
+func (c *client) authTLS(conf *tls.Config) {
+	c.t.Helper()
+	c.cmd(234, "AUTH TLS")
+	c.conn = tls.Client(c.conn, conf)
+	c.Conn = textproto.NewConn(c.conn)
+	c.tls = conf
+	c.cmd(200, "PBSZ 0")
+	c.cmd(200, "PROT P")
+}
+
+// Data connection, protected if needed.
+func (c *client) wrap(conn net.Conn) net.Conn {
+	if c.tls == nil {
+		return conn
+	}
+	return tls.Client(conn, c.tls)
+}
+
+func (c *client) expect(code int) string {
+	c.t.Helper()
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		c.t.Fatalf("expected %d: %s", code, err)
+	}
+	return msg
+}
+
+// Sends a command, expecting a reply with the given code.
+func (c *client) cmd(code int, format string, args ...any) string {
+	c.t.Helper()
+	if _, err := c.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+// Sets up a data connection, as per c.mode; the returned function
+// gets the connection, once the transfer command has been sent.
+func (c *client) data() func() net.Conn {
+	c.t.Helper()
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+
+	switch c.mode {
+	case "PORT", "EPRT":
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		p := ln.Addr().(*net.TCPAddr).Port
+		if c.mode == "PORT" {
+			c.cmd(200, "PORT %s,%d,%d", strings.ReplaceAll(host, ".", ","), p/256, p%256)
+		} else {
+			proto := 1
+			if strings.Contains(host, ":") {
+				proto = 2
+			}
+			c.cmd(200, "EPRT |%d|%s|%d|", proto, host, p)
+		}
+		return func() net.Conn {
+			defer ln.Close()
+			conn, err := ln.Accept()
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			return conn
+		}
+
+	case "PASV":
+		msg := c.cmd(227, "PASV")
+		var h [4]int
+		var p1, p2 int
+		i := strings.Index(msg, "(")
+		_, err := fmt.Sscanf(msg[i:], "(%d,%d,%d,%d,%d,%d)", &h[0], &h[1], &h[2], &h[3], &p1, &p2)
+		if err != nil {
+			c.t.Fatalf("unexpected PASV reply %s: %s", msg, err)
+		}
+		addr := fmt.Sprintf("%d.%d.%d.%d:%d", h[0], h[1], h[2], h[3], p1*256+p2)
+		return c.connect(addr)
+
+	case "EPSV":
+		msg := c.cmd(229, "EPSV")
+		var p int
+		i := strings.Index(msg, "(")
+		if _, err := fmt.Sscanf(msg[i:], "(|||%d|)", &p); err != nil {
+			c.t.Fatalf("unexpected EPSV reply %s: %s", msg, err)
+		}
+		rhost, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+		return c.connect(net.JoinHostPort(rhost, strconv.Itoa(p)))
+	}
+
+	c.t.Fatalf("unknown mode %s", c.mode)
+	return nil
+}
+
+func (c *client) connect(addr string) func() net.Conn {
+	c.t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return func() net.Conn { return conn }
+}
+
+// REST, if needed, once the data connection is set up.
+func (c *client) restart() {
+	c.t.Helper()
+	if c.rest != 0 {
+		c.cmd(350, "REST %d", c.rest)
+		c.rest = 0
+	}
+}
+
+func (c *client) stor(cmd, data string) string {
+	c.t.Helper()
+	get := c.data()
+	c.restart()
+	msg := c.cmd(150, "%s", cmd)
+	conn := c.wrap(get())
+	io.WriteString(conn, data)
+	conn.Close()
+	c.expect(226)
+	return msg
+}
+
+func (c *client) retr(fn string) string {
+	c.t.Helper()
+	get := c.data()
+	c.restart()
+	c.cmd(150, "RETR %s", fn)
+	conn := c.wrap(get())
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	conn.Close()
+	c.expect(226)
+	return string(b)
+}
+
+func readFile(t *testing.T, fn string) string {
+	t.Helper()
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFtpdTransfers(t *testing.T) {
+	t.Chdir(t.TempDir())
+	addr := startServer(t)
+
+	for _, mode := range []string{"PORT", "EPRT", "PASV", "EPSV"} {
+		t.Run(mode, func(t *testing.T) {
+			c := dial(t, addr)
+			c.mode = mode
+			testTransfers(t, c)
+		})
+	}
+}
+
+func testTransfers(t *testing.T, c *client) {
+
+	c.cmd(200, "TYPE I")
+	c.stor("STOR a.bin", "hello\r\nworld\n")
+	if s := readFile(t, "a.bin"); s != "hello\r\nworld\n" {
+		t.Errorf("TYPE I: unexpected content: %q", s)
+	}
+	if s := c.cmd(213, "SIZE a.bin"); s != "13" {
+		t.Errorf("TYPE I: unexpected size: %s", s)
+	}
+
+	c.stor("APPE a.bin", "!")
+	if s := c.retr("a.bin"); s != "hello\r\nworld\n!" {
+		t.Errorf("TYPE I: unexpected RETR: %q", s)
+	}
+
+	// ASCII: CRLF on the wire, LF on disk
+	c.cmd(200, "TYPE A N")
+	c.stor("STOR a.txt", "one\r\ntwo\r\n\r\nthree\rfour\r\n")
+	if s := readFile(t, "a.txt"); s != "one\ntwo\n\nthree\rfour\n" {
+		t.Errorf("TYPE A: unexpected content: %q", s)
+	}
+	if s := c.retr("a.txt"); s != "one\r\ntwo\r\n\r\nthree\rfour\r\n" {
+		t.Errorf("TYPE A: unexpected RETR: %q", s)
+	}
+	if s := c.cmd(213, "SIZE a.txt"); s != "24" {
+		t.Errorf("TYPE A: unexpected size: %s", s)
+	}
+
+	msg := c.stor("STOU", "unique")
+	fn, ok := strings.CutPrefix(msg, "FILE: ")
+	if !ok {
+		t.Fatalf("Unexpected STOU reply: %s", msg)
+	}
+	if s := readFile(t, fn); s != "unique" {
+		t.Errorf("STOU: unexpected content: %q", s)
+	}
+}
+
+func TestFtpdFileCommands(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := dial(t, startServer(t))
+
+	c.cmd(200, "NOOP")
+	if err := os.WriteFile("f", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.cmd(213, "MDTM f"); !regexp.MustCompile(`^\d{14}$`).MatchString(s) {
+		t.Errorf("Unexpected MDTM reply: %s", s)
+	}
+
+	c.cmd(257, "MKD d")
+	c.cmd(550, "MKD d")
+	c.cmd(550, "DELE d")
+	c.cmd(550, "RMD f")
+	c.cmd(550, "SIZE d")
+
+	c.cmd(503, "RNTO g")
+	c.cmd(550, "RNFR nope")
+	c.cmd(350, "RNFR f")
+	c.cmd(250, "RNTO d/g")
+	if s := readFile(t, filepath.Join("d", "g")); s != "x" {
+		t.Errorf("Unexpected content after RNTO: %q", s)
+	}
+
+	c.cmd(250, "CWD d")
+	c.cmd(250, "DELE g")
+	c.cmd(550, "DELE g")
+	c.cmd(250, "CWD ..")
+	c.cmd(250, "RMD d")
+	if _, err := os.Stat("d"); !os.IsNotExist(err) {
+		t.Errorf("d should have been removed: %v", err)
+	}
+
+	c.cmd(550, "MDTM f")
+	c.cmd(425, "STOR f")
+}
+
+func TestFtpdParameters(t *testing.T) {
+	c := dial(t, startServer(t))
+
+	for _, x := range []struct {
+		cmd  string
+		code int
+	}{
+		{"TYPE I", 200},
+		{"type l 8", 200},
+		{"TYPE A", 200},
+		{"TYPE E", 504},
+		{"TYPE A T", 504},
+		{"TYPE X", 501},
+		{"MODE S", 200},
+		{"MODE B", 504},
+		{"MODE X", 501},
+		{"STRU F", 200},
+		{"STRU R", 504},
+		{"STRU", 501},
+	} {
+		c.cmd(x.code, "%s", x.cmd)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	for _, x := range []struct{ lf, crlf string }{
+		{"", ""},
+		{"a\nb", "a\r\nb"},
+		{"a\r\n", "a\r\n"},
+		{"\n\n", "\r\n\r\n"},
+	} {
+		var b strings.Builder
+		w := &toCRLF{w: &b}
+		// byte by byte
+		for i := range len(x.lf) {
+			w.Write([]byte{x.lf[i]})
+		}
+		if b.String() != x.crlf {
+			t.Errorf("%q: got %q, expected %q", x.lf, b.String(), x.crlf)
+		}
+	}
+
+	for _, x := range []struct{ crlf, lf string }{
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"a\rb", "a\rb"},
+		{"a\r", "a\r"},
+		{"\r\r\n", "\r\n"},
+	} {
+		var b strings.Builder
+		w := &fromCRLF{w: &b}
+		for i := range len(x.crlf) {
+			w.Write([]byte{x.crlf[i]})
+		}
+		w.Flush()
+		if b.String() != x.lf {
+			t.Errorf("%q: got %q, expected %q", x.crlf, b.String(), x.lf)
+		}
+	}
+}
+
+func TestFtpdIPv6(t *testing.T) {
+	t.Chdir(t.TempDir())
+	addr := startServer(t, "::1")
+
+	for _, mode := range []string{"EPRT", "EPSV"} {
+		t.Run(mode, func(t *testing.T) {
+			c := dial(t, addr)
+			c.mode = mode
+			c.cmd(200, "TYPE I")
+			c.stor("STOR f", "hello")
+			if s := c.retr("f"); s != "hello" {
+				t.Errorf("Unexpected RETR: %q", s)
+			}
+		})
+	}
+
+	c := dial(t, addr)
+	c.cmd(425, "PASV")
+	c.cmd(522, "EPSV 1")
+	c.cmd(501, "EPRT |1|::1|1234|")
+	c.cmd(500, "EPRT |1|127.0.0.1|1234|")
+}
+
+func TestFtpdDataCommands(t *testing.T) {
+	c := dial(t, startServer(t))
+
+	c.cmd(425, "RETR f")
+	c.cmd(425, "LIST")
+
+	// bounce attacks
+	c.cmd(500, "PORT 10,1,2,3,4,5")
+	c.cmd(500, "EPRT |1|10.1.2.3|1029|")
+
+	c.cmd(501, "PORT 127,0,0,1,4")
+	c.cmd(501, "PORT 127,0,0,1,256,1")
+	c.cmd(501, "EPRT |1|127.0.0.1|")
+	c.cmd(522, "EPRT |3|127.0.0.1|1029|")
+	c.cmd(501, "EPRT |1|127.0.0.1|0|")
+	c.cmd(522, "EPSV 2")
+
+	c.cmd(200, "EPSV ALL")
+	c.cmd(503, "PORT 127,0,0,1,4,5")
+	c.cmd(503, "PASV")
+	c.cmd(229, "EPSV")
+}
+
+func TestFtpdPassiveSettings(t *testing.T) {
+	// find a free range; a few ports should be enough
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	srv := &Server{PasvMin: p, PasvMax: p + 2}
+
+	c := dial(t, startServerWith(t, srv))
+	for i := 0; i < 3; i++ {
+		var n int
+		msg := c.cmd(229, "EPSV")
+		fmt.Sscanf(msg[strings.Index(msg, "("):], "(|||%d|)", &n)
+		if n < srv.PasvMin || n > srv.PasvMax {
+			t.Errorf("Port %d not in %d-%d", n, srv.PasvMin, srv.PasvMax)
+		}
+	}
+
+	c = dial(t, startServerWith(t, &Server{PasvAddr: "10.1.2.3"}))
+	if msg := c.cmd(227, "PASV"); !strings.Contains(msg, "(10,1,2,3,") {
+		t.Errorf("Unexpected advertised address: %s", msg)
+	}
+}
+
+// Serves a fresh root directory, with a sibling "outside" one,
+// and symlinks to it; returns both directories.
+func startJail(t *testing.T) (c *client, in, out string) {
+	dir := t.TempDir()
+	in, out = filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{in, filepath.Join(in, "d"), out} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fn, s := range map[string]string{
+		filepath.Join(out, "secret"): "secret",
+		filepath.Join(in, "d", "f"):  "public",
+	} {
+		if err := os.WriteFile(fn, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"secret":   filepath.Join(out, "secret"),
+		"out":      out,
+		"rel":      "../outside/secret",
+		"dangling": filepath.Join(out, "new"),
+		"ok":       "d/f",
+	} {
+		if err := os.Symlink(target, filepath.Join(in, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	c = dial(t, startServerWith(t, &Server{Root: in}))
+	c.cmd(200, "TYPE I")
+	return c, in, out
+}
+
+func TestFtpdJail(t *testing.T) {
+	c, _, out := startJail(t)
+
+	if s := c.cmd(257, "PWD"); s != `"/" is current directory` {
+		t.Errorf("Unexpected PWD: %s", s)
+	}
+	c.cmd(250, "CWD ../../..")
+	if s := c.cmd(257, "PWD"); s != `"/" is current directory` {
+		t.Errorf("Unexpected PWD: %s", s)
+	}
+	c.cmd(250, "CWD d")
+	if s := c.cmd(257, "PWD"); s != `"/d" is current directory` {
+		t.Errorf("Unexpected PWD: %s", s)
+	}
+	c.cmd(250, "CDUP")
+	c.cmd(250, "CDUP")
+	if s := c.cmd(257, "PWD"); s != `"/" is current directory` {
+		t.Errorf("Unexpected PWD: %s", s)
+	}
+
+	// ".." can't go above the root: relative to it
+	c.cmd(550, "SIZE ../outside/secret")
+	c.cmd(550, "SIZE /../../outside/secret")
+	c.cmd(213, "SIZE ../d/f")
+	c.cmd(213, "SIZE /d/../../d/f")
+
+	// symlinks are followed, but only inside the root
+	if s := c.retr("ok"); s != "public" {
+		t.Errorf("Unexpected RETR: %q", s)
+	}
+	for _, cmd := range []string{
+		"RETR ../../etc/passwd", "RETR /../etc/passwd",
+		"RETR secret", "RETR rel", "RETR out/secret", "SIZE secret",
+		"MDTM rel", "CWD out", "DELE secret", "RNFR secret",
+		"MKD out/d", "STOR out/new", "STOR dangling", "APPE secret",
+		"RMD out",
+	} {
+		// no need for a data connection
+		c.cmd(550, "%s", cmd)
+	}
+
+	// renaming to the outside
+	c.cmd(350, "RNFR ok")
+	c.cmd(550, "RNTO out/ok")
+
+	// nor the root itself
+	c.cmd(550, "RMD /")
+	c.cmd(550, "RNFR ..")
+
+	xs, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 1 || xs[0].Name() != "secret" {
+		t.Errorf("The outside directory has been modified: %v", xs)
+	}
+}
+
+// Symlinks are removed or renamed themselves, not their targets.
+func TestFtpdJailSymlinks(t *testing.T) {
+	c, in, _ := startJail(t)
+	if err := os.Symlink("d/f", filepath.Join(in, "ok2")); err != nil {
+		t.Fatal(err)
+	}
+
+	c.cmd(250, "DELE ok")
+	if _, err := os.Lstat(filepath.Join(in, "ok")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Symlink not removed: %v", err)
+	}
+
+	c.cmd(350, "RNFR ok2")
+	c.cmd(250, "RNTO ok3")
+	if fi, err := os.Lstat(filepath.Join(in, "ok3")); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Symlink not renamed: %v", err)
+	}
+
+	if s := readFile(t, filepath.Join(in, "d", "f")); s != "public" {
+		t.Errorf("Target modified: %q", s)
+	}
+	c.stor("STOR ok", "new")
+	if s := readFile(t, filepath.Join(in, "ok")); s != "new" {
+		t.Errorf("Unexpected content: %q", s)
+	}
+}
+
+// Real paths shouldn't be leaked.
+func TestFtpdJailErrors(t *testing.T) {
+	c, _, _ := startJail(t)
+
+	msg := c.cmd(550, "SIZE nope")
+	if msg != "nope: No such file or directory" {
+		t.Errorf("Unexpected error message: %s", msg)
+	}
+	if msg := c.cmd(550, "MDTM secret"); msg != "secret: Permission denied" {
+		t.Errorf("Unexpected error message: %s", msg)
+	}
+}
+
+// Errors without a message (e.g. from an FS) don't panic.
+func TestReplyErrEmpty(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		replyErr(c1, 550, "f", errors.New(""))
+		replyErr(c1, 552, "", &codeError{552, ""})
+	}()
+
+	r := textproto.NewReader(bufio.NewReader(c2))
+	for _, exp := range []string{"550 f: ", "552 .: "} {
+		if s, err := r.ReadLine(); err != nil || s != exp {
+			t.Errorf("Expected %q, got %q (%v)", exp, s, err)
+		}
+	}
+}
+
+func TestRealPath(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "a"), 0755)
+
+	for _, x := range []struct {
+		v   string
+		exp string
+		err bool
+	}{
+		{"/", dir, false},
+		{"/a", filepath.Join(dir, "a"), false},
+		{"/a/new", filepath.Join(dir, "a", "new"), false},
+		{"/nope/new", "", true},
+	} {
+		p, err := realPath(dir, x.v)
+		exp, _ := filepath.EvalSymlinks(filepath.Dir(x.exp))
+		if x.exp != "" {
+			exp = filepath.Join(exp, filepath.Base(x.exp))
+		}
+		if (err != nil) != x.err || (!x.err && p != exp) {
+			t.Errorf("%s: got %q, %v; expected %q", x.v, p, err, exp)
+		}
+	}
+
+	for _, x := range []struct {
+		v    string
+		want string
+	}{
+		{"", "/w"},
+		{"..", "/"},
+		{"../../x", "/x"},
+		{"/../x/./y", "/x/y"},
+		{"a/", "/w/a"},
+	} {
+		if got := vpath(x.v, &Session{wd: "/w"}); got != x.want {
+			t.Errorf("vpath(%q) = %q, expected %q", x.v, got, x.want)
+		}
+	}
+}
+
+func TestFtpdLogin(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := dialNoLogin(t, startServer(t))
+
+	for _, cmd := range []string{"PWD", "RETR f", "STOR f", "PASV", "LIST", "CWD /"} {
+		c.cmd(530, "%s", cmd)
+	}
+	c.cmd(503, "PASS x")
+	c.cmd(501, "USER")
+
+	c.cmd(331, "USER nobody")
+	c.cmd(530, "PASS x")
+	c.cmd(530, "PWD")
+
+	c.cmd(331, "USER ftp")
+	c.cmd(230, "PASS x")
+	c.cmd(257, "PWD")
+	c.cmd(230, "PASS x")
+
+	// USER logs out
+	c.cmd(331, "USER anonymous")
+	c.cmd(530, "PWD")
+
+	c.cmd(221, "QUIT")
+}
+
+func hash(t *testing.T, pass string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestFtpdHtpasswd(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"alice", "bob"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "bob", "f"), []byte("bob's"), 0644)
+
+	h, err := ReadHtpasswd(strings.NewReader(fmt.Sprintf(`
+# comment
+alice:%s:alice:rw
+bob:%s:bob
+root:%s
+`, hash(t, "secret"), hash(t, "hunter2"), hash(t, "root"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startServerWith(t, &Server{Root: dir, Auth: Authenticators{h, Anonymous{}}})
+
+	c := dialNoLogin(t, addr)
+	c.cmd(331, "USER alice")
+	c.cmd(530, "PASS hunter2")
+	c.cmd(331, "USER alice")
+	c.cmd(230, "PASS secret")
+	c.mode = "EPSV"
+	c.cmd(200, "TYPE I")
+	c.stor("STOR a", "alice's")
+	if s := readFile(t, filepath.Join(dir, "alice", "a")); s != "alice's" {
+		t.Errorf("Unexpected content: %q", s)
+	}
+	// jailed in her home
+	c.cmd(550, "SIZE ../bob/f")
+
+	// read-only
+	c = dialNoLogin(t, addr)
+	c.cmd(331, "USER bob")
+	c.cmd(230, "PASS hunter2")
+	c.mode = "EPSV"
+	if s := c.retr("f"); s != "bob's" {
+		t.Errorf("Unexpected RETR: %q", s)
+	}
+	for _, cmd := range []string{"STOR g", "APPE f", "DELE f", "MKD d", "RNFR f", "STOU"} {
+		c.cmd(550, "%s", cmd)
+	}
+
+	// whole root, read-only
+	c = dialNoLogin(t, addr)
+	c.cmd(331, "USER root")
+	c.cmd(230, "PASS root")
+	c.cmd(213, "SIZE bob/f")
+
+	// anonymous, read-only
+	c = dialNoLogin(t, addr)
+	c.cmd(331, "USER anonymous")
+	c.cmd(230, "PASS x")
+	c.cmd(213, "SIZE alice/a")
+	c.cmd(550, "DELE alice/a")
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	for _, s := range []string{
+		"alice",
+		"alice:notahash",
+		"alice:" + hash(t, "x") + ":home:x",
+		"alice:" + hash(t, "x") + ":home:rw:extra",
+		"alice:" + hash(t, "x") + ":home:rw:1G:extra",
+	} {
+		if _, err := ReadHtpasswd(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+
+	h, err := ReadHtpasswd(strings.NewReader("alice:" + hash(t, "x") + ":home:rw:2M"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := h.Authenticate("alice", "x")
+	if err != nil || acc.Quota != 2<<20 {
+		t.Errorf("Unexpected account: %+v, %v", acc, err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, exp := range map[string]int64{
+		"0": 0, "123": 123, "1K": 1024, "512K": 512 << 10,
+		"3M": 3 << 20, "1G": 1 << 30, "2T": 2 << 40,
+	} {
+		if n, err := parseSize(s); err != nil || n != exp {
+			t.Errorf("%s: got %d, %v; expected %d", s, n, err, exp)
+		}
+	}
+	for _, s := range []string{"", "K", "-1", "1KB", "1k", "x", "9999999999T"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestFtpdLoginRateLimit(t *testing.T) {
+	srv := &Server{MaxFailures: 3}
+	addr := startServerWith(t, srv)
+	c := dialNoLogin(t, addr)
+	for i := 0; i < srv.MaxFailures; i++ {
+		c.cmd(331, "USER nobody")
+		c.cmd(530, "PASS x")
+	}
+	c.cmd(421, "USER anonymous")
+
+	// from a new connection, even with valid credentials
+	c = dialNoLogin(t, addr)
+	c.cmd(421, "USER anonymous")
+
+	// failures eventually expire
+	f := &srv.failures
+	f.mu.Lock()
+	for ip, ts := range f.ips {
+		for i := range ts {
+			ts[i] = ts[i].Add(-f.window - time.Second)
+		}
+		f.ips[ip] = ts
+	}
+	f.mu.Unlock()
+	dial(t, addr)
+}
+
+// Self-signed certificate, for 127.0.0.1: the server's and the
+// client's configurations.
+func setupTLS(t *testing.T) (srv, cli *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return srv, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+func TestFtpdExplicitTLS(t *testing.T) {
+	t.Chdir(t.TempDir())
+	sconf, conf := setupTLS(t)
+	addr := startServerWith(t, &Server{TLSConfig: sconf})
+
+	for _, mode := range []string{"PORT", "EPSV"} {
+		t.Run(mode, func(t *testing.T) {
+			c := dialNoLogin(t, addr)
+			c.authTLS(conf)
+			c.cmd(331, "USER anonymous")
+			c.cmd(230, "PASS x")
+			c.cmd(200, "TYPE I")
+			c.mode = mode
+
+			c.stor("STOR f", "secret")
+			if s := c.retr("f"); s != "secret" {
+				t.Errorf("Unexpected RETR: %q", s)
+			}
+			if _, ok := c.conn.(*tls.Conn); !ok {
+				t.Errorf("Control connection not protected")
+			}
+		})
+	}
+
+	c := dialNoLogin(t, addr)
+	c.cmd(503, "PBSZ 0")
+	c.cmd(503, "PROT P")
+	c.cmd(504, "AUTH KERBEROS")
+	c.authTLS(conf)
+	c.cmd(503, "AUTH TLS")
+	c.cmd(536, "PROT S")
+	c.cmd(504, "PROT X")
+	c.cmd(200, "PROT C")
+}
+
+func TestFtpdImplicitTLS(t *testing.T) {
+	t.Chdir(t.TempDir())
+	sconf, conf := setupTLS(t)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveAll(t, &Server{TLSConfig: sconf}, ln)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, conn)
+	// data connections are protected by default
+	c.tls = conf
+	c.mode = "PASV"
+	c.cmd(331, "USER anonymous")
+	c.cmd(230, "PASS x")
+	c.stor("STOR f", "implicit")
+	if s := readFile(t, "f"); s != "implicit" {
+		t.Errorf("Unexpected content: %q", s)
+	}
+}
+
+func TestFtpdTLSRequired(t *testing.T) {
+	t.Chdir(t.TempDir())
+	sconf, conf := setupTLS(t)
+	addr := startServerWith(t, &Server{TLSConfig: sconf, TLSRequired: true})
+	c := dialNoLogin(t, addr)
+	c.cmd(530, "USER anonymous")
+	c.cmd(234, "AUTH TLS")
+	c.conn = tls.Client(c.conn, conf)
+	c.Conn = textproto.NewConn(c.conn)
+	c.cmd(331, "USER anonymous")
+	c.cmd(230, "PASS x")
+	c.cmd(229, "EPSV")
+	c.cmd(521, "LIST")
+	c.cmd(200, "PBSZ 0")
+	c.cmd(534, "PROT C")
+	c.cmd(200, "PROT P")
+	c.tls = conf
+	c.mode = "EPSV"
+	c.stor("STOR f", "required")
+}
+
+// Clients that never complete the handshake, after AUTH TLS or
+// with implicit TLS, don't hold their session.
+func TestFtpdTLSHandshakeTimeout(t *testing.T) {
+	sconf, _ := setupTLS(t)
+	srv := &Server{TLSConfig: sconf, IdleTimeout: 100 * time.Millisecond}
+
+	c := dialNoLogin(t, startServerWith(t, srv))
+	c.cmd(234, "AUTH TLS")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c.conn); err != nil {
+		t.Errorf("Connection not closed: %s", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveAll(t, srv, ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Connection not closed: %s", err)
+	}
+}
+
+// Commands sent in clear after AUTH TLS could have been
+// injected: the connection is closed.
+func TestFtpdTLSInjection(t *testing.T) {
+	sconf, _ := setupTLS(t)
+	c := dialNoLogin(t, startServerWith(t, &Server{TLSConfig: sconf}))
+	c.PrintfLine("AUTH TLS\r\nUSER anonymous")
+	c.expect(234)
+	if _, _, err := c.ReadResponse(0); err == nil {
+		t.Errorf("The connection should have been closed")
+	}
+}
+
+// Sends a listing command; returns the lines read.
+func (c *client) list(format string, args ...any) []string {
+	c.t.Helper()
+	get := c.data()
+	c.cmd(150, format, args...)
+	conn := c.wrap(get())
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	conn.Close()
+	c.expect(226)
+
+	s := string(b)
+	if !strings.HasSuffix(s, "\r\n") {
+		c.t.Fatalf("Listing not terminated by CRLF: %q", s)
+	}
+	return strings.Split(strings.TrimSuffix(s, "\r\n"), "\r\n")
+}
+
+var lsRe = regexp.MustCompile(
+	`^([-d])([-r][-w][-x][-r][-w][-x][-r][-w][-x]) +1 ftp ftp +(\d+) ` +
+		`([A-Z][a-z]{2} [ \d]\d (?:\d\d:\d\d| \d{4})) (.+)$`)
+
+// Parses "type=file;size=3;... name" lines.
+func parseFacts(t *testing.T, s string) (map[string]string, string) {
+	t.Helper()
+	fs, name, ok := strings.Cut(s, " ")
+	if !ok || !strings.HasSuffix(fs, ";") {
+		t.Fatalf("Malformed MLSx line: %q", s)
+	}
+	m := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimSuffix(fs, ";"), ";") {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			t.Fatalf("Malformed fact %q in %q", f, s)
+		}
+		m[k] = v
+	}
+	return m, name
+}
+
+func TestFtpdListings(t *testing.T) {
+	c, in, _ := startJail(t)
+	// in: d/f, and symlinks (only "ok" stays inside)
+	old := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(in, "d", "f"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	ls := c.list("LIST -la")
+	if len(ls) != 2 {
+		t.Fatalf("Unexpected LIST: %q", ls)
+	}
+	for i, exp := range []struct{ kind, size, date, name string }{
+		{"d", "", "", "d"},
+		{"-", "6", "Feb  3  2001", "ok"},
+	} {
+		m := lsRe.FindStringSubmatch(ls[i])
+		if m == nil {
+			t.Fatalf("Unexpected LIST line: %q", ls[i])
+		}
+		if m[1] != exp.kind || m[5] != exp.name ||
+			(exp.size != "" && m[3] != exp.size) ||
+			(exp.date != "" && m[4] != exp.date) {
+			t.Errorf("Unexpected LIST line: %q", ls[i])
+		}
+	}
+	recent := lsRe.FindStringSubmatch(ls[0])[4]
+	if !regexp.MustCompile(`\d\d:\d\d$`).MatchString(recent) {
+		t.Errorf("Recent date without a time: %q", recent)
+	}
+
+	if ls := c.list("LIST d"); len(ls) != 1 || !strings.HasSuffix(ls[0], " f") {
+		t.Errorf("Unexpected LIST d: %q", ls)
+	}
+	if ls := c.list("LIST d/f"); len(ls) != 1 || !strings.HasSuffix(ls[0], " f") {
+		t.Errorf("Unexpected LIST d/f: %q", ls)
+	}
+	if ls := c.list("NLST"); strings.Join(ls, ",") != "d,ok" {
+		t.Errorf("Unexpected NLST: %q", ls)
+	}
+
+	ms := c.list("MLSD")
+	if len(ms) != 2 {
+		t.Fatalf("Unexpected MLSD: %q", ms)
+	}
+	d, name := parseFacts(t, ms[0])
+	if name != "d" || d["type"] != "dir" || d["perm"] != "cdeflmp" {
+		t.Errorf("Unexpected MLSD line: %q", ms[0])
+	}
+	f, name := parseFacts(t, ms[1])
+	if name != "ok" || f["type"] != "file" || f["size"] != "6" ||
+		f["modify"] != "20010203040506" || f["perm"] != "adfrw" {
+		t.Errorf("Unexpected MLSD line: %q", ms[1])
+	}
+
+	// same file, through the symlink
+	msg := c.cmd(250, "MLST d/f")
+	lines := strings.Split(msg, "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], " ") {
+		t.Fatalf("Unexpected MLST: %q", msg)
+	}
+	g, name := parseFacts(t, lines[1][1:])
+	if name != "/d/f" || g["unique"] != f["unique"] || g["unique"] == "" {
+		t.Errorf("Unexpected MLST: %q (MLSD: %q)", lines[1], ms[1])
+	}
+
+	c.cmd(501, "MLSD d/f")
+	c.cmd(550, "MLST nope")
+	c.cmd(550, "MLST secret")
+
+	c.cmd(200, "OPTS MLST size;Type;bogus;")
+	if msg := c.cmd(250, "MLST d/f"); strings.Split(msg, "\n")[1] != " type=file;size=6; /d/f" {
+		t.Errorf("Unexpected MLST after OPTS: %q", msg)
+	}
+	c.cmd(501, "OPTS NOPE")
+}
+
+func TestFtpdFeat(t *testing.T) {
+	c := dialNoLogin(t, startServer(t))
+
+	msg := c.cmd(211, "FEAT")
+	fs := strings.Split(msg, "\n")
+	if len(fs) < 3 || fs[len(fs)-1] != "End" {
+		t.Fatalf("Unexpected FEAT: %q", msg)
+	}
+	for _, f := range []string{"MLST type*;size*;modify*;perm*;unique*;", "SIZE", "UTF8"} {
+		if !slices.Contains(fs, " "+f) {
+			t.Errorf("%s not in FEAT: %q", f, msg)
+		}
+	}
+	if slices.Contains(fs, " AUTH TLS") {
+		t.Errorf("AUTH TLS advertised without TLS: %q", msg)
+	}
+
+	c.cmd(200, "OPTS UTF8 ON")
+	c.cmd(200, "OPTS MLST type;")
+	if msg := c.cmd(211, "FEAT"); !strings.Contains(msg, "MLST type*;size;modify;perm;unique;") {
+		t.Errorf("Unexpected FEAT after OPTS: %q", msg)
+	}
+}
+
+func TestFtpdRestart(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := dial(t, startServer(t))
+	c.cmd(200, "TYPE I")
+
+	c.stor("STOR f", "0123456789")
+	c.rest = 4
+	if s := c.retr("f"); s != "456789" {
+		t.Errorf("Unexpected RETR after REST: %q", s)
+	}
+	// only for the next command
+	if s := c.retr("f"); s != "0123456789" {
+		t.Errorf("Unexpected RETR: %q", s)
+	}
+
+	// resumed upload: what's past the offset is replaced
+	c.rest = 6
+	c.stor("STOR f", "ab")
+	if s := readFile(t, "f"); s != "012345ab" {
+		t.Errorf("Unexpected content after REST, STOR: %q", s)
+	}
+
+	// APPE ignores it
+	c.rest = 2
+	c.stor("APPE f", "!")
+	if s := readFile(t, "f"); s != "012345ab!" {
+		t.Errorf("Unexpected content after REST, APPE: %q", s)
+	}
+
+	c.cmd(501, "REST -1")
+	c.cmd(501, "REST x")
+	c.data()
+	c.cmd(350, "REST 100")
+	c.cmd(554, "RETR f")
+	c.cmd(350, "REST 100")
+	c.cmd(554, "STOR f")
+	if s := readFile(t, "f"); s != "012345ab!" {
+		t.Errorf("Unexpected content after failed REST: %q", s)
+	}
+}
+
+func TestFtpdAbort(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := dial(t, startServer(t))
+	c.cmd(200, "TYPE I")
+
+	c.cmd(225, "ABOR")
+
+	// upload in progress: the data connection stays open
+	get := c.data()
+	c.cmd(150, "STOR f")
+	sock := get()
+	defer sock.Close()
+	if _, err := io.WriteString(sock, "partial"); err != nil {
+		t.Fatal(err)
+	}
+	// as sent by some clients, with Telnet IP/Synch
+	if _, err := io.WriteString(c.conn, "\xff\xf4\xff\xf2ABOR\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(426)
+	c.expect(226)
+	c.cmd(200, "NOOP")
+
+	// download in progress, the client not reading
+	if err := os.WriteFile("big", make([]byte, 64<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	get = c.data()
+	c.cmd(150, "RETR big")
+	sock = get()
+	defer sock.Close()
+	c.cmd(426, "ABOR")
+	c.expect(226)
+
+	// other commands wait for the transfer to be over
+	get = c.data()
+	c.cmd(150, "STOR g")
+	sock = get()
+	c.Cmd("NOOP")
+	io.WriteString(sock, "done")
+	sock.Close()
+	c.expect(226)
+	c.expect(200)
+	if s := readFile(t, "g"); s != "done" {
+		t.Errorf("Unexpected content: %q", s)
+	}
+}
+
+// Serves srv on a random port, until the end of the test.
+func startServerWith(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveAll(t, srv, ln)
+	return ln.Addr().String()
+}
+
+func TestFtpdShutdown(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := &Server{}
+	addr := startServerWith(t, srv)
+
+	idle := dial(t, addr)
+	c := dial(t, addr)
+	c.cmd(200, "TYPE I")
+
+	// a transfer in progress is drained
+	get := c.data()
+	c.cmd(150, "STOR f")
+	sock := get()
+	io.WriteString(sock, "hello")
+
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	idle.expect(421)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("New connection accepted while shutting down")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned during a transfer: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	io.WriteString(sock, ", world")
+	sock.Close()
+	c.expect(226)
+	c.expect(421)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected Shutdown error: %s", err)
+	}
+	if s := readFile(t, "f"); s != "hello, world" {
+		t.Errorf("Unexpected content: %q", s)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Unexpected Serve error after Shutdown: %v", err)
+	}
+}
+
+// Transfers are aborted when the shutdown times out.
+func TestFtpdShutdownTimeout(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := &Server{}
+	c := dial(t, startServerWith(t, srv))
+
+	get := c.data()
+	c.cmd(150, "STOR f")
+	sock := get()
+	defer sock.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected Shutdown error: %v", err)
+	}
+	if _, err := io.ReadAll(sock); err != nil {
+		t.Errorf("Data connection not closed: %s", err)
+	}
+}
+
+func TestFtpdMaxConns(t *testing.T) {
+	addr := startServerWith(t, &Server{MaxConns: 2})
+
+	c := dial(t, addr)
+	dial(t, addr)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	if _, _, err := tc.ReadResponse(421); err != nil {
+		t.Errorf("Expected 421: %s", err)
+	}
+
+	// room for a new one
+	c.cmd(221, "QUIT")
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _, _ := textproto.NewConn(conn).ReadResponse(0)
+		conn.Close()
+		if code == 220 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Still rejected after QUIT: %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFtpdIdleTimeout(t *testing.T) {
+	t.Chdir(t.TempDir())
+	addr := startServerWith(t, &Server{IdleTimeout: 100 * time.Millisecond})
+
+	idle := dial(t, addr)
+	start := time.Now()
+	idle.expect(421)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Closed too early: %s", d)
+	}
+
+	// not idle while transferring
+	c := dial(t, addr)
+	get := c.data()
+	c.cmd(150, "STOR f")
+	sock := get()
+	io.WriteString(sock, "slow")
+	time.Sleep(300 * time.Millisecond)
+	sock.Close()
+	c.expect(226)
+	c.cmd(200, "NOOP")
+	c.expect(421)
+}
+
+func TestFtpdAccessLog(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var b bytes.Buffer
+	srv := &Server{Log: slog.New(slog.NewJSONHandler(&b, nil))}
+	c := dial(t, startServerWith(t, srv))
+	c.cmd(200, "TYPE I")
+	c.stor("STOR f", "x")
+	c.cmd(502, "NOPE")
+	c.cmd(221, "QUIT")
+	c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	type record struct {
+		Msg     string
+		Session uint64
+		User    string
+		Cmd     string
+		Arg     string
+		Code    int
+	}
+	var got []record
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Session != 1 {
+			t.Errorf("Unexpected session: %+v", r)
+		}
+		r.Session = 0
+		got = append(got, r)
+	}
+
+	// the transfer is over before the next command
+	exp := []record{
+		{Msg: "connect"},
+		{Msg: "command", Cmd: "USER", Arg: "anonymous", Code: 331},
+		{Msg: "command", User: "anonymous", Cmd: "PASS", Arg: "****", Code: 230},
+		{Msg: "command", User: "anonymous", Cmd: "TYPE", Arg: "I", Code: 200},
+		{Msg: "command", User: "anonymous", Cmd: "PORT", Code: 200},
+		{Msg: "command", User: "anonymous", Cmd: "STOR", Arg: "f", Code: 150},
+		{Msg: "transfer", User: "anonymous", Code: 226},
+		{Msg: "command", User: "anonymous", Cmd: "NOPE", Code: 502},
+		{Msg: "command", User: "anonymous", Cmd: "QUIT", Code: 221},
+		{Msg: "disconnect", User: "anonymous"},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("Unexpected access log: %+v", got)
+	}
+	for i := range exp {
+		if exp[i].Cmd == "PORT" {
+			got[i].Arg = ""
+		}
+		if got[i] != exp[i] {
+			t.Errorf("Unexpected record %d: %+v, expected %+v", i, got[i], exp[i])
+		}
+	}
+}
+
+func TestFtpdXferlog(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var b bytes.Buffer
+	c := dial(t, startServerWith(t, &Server{Xferlog: &b}))
+
+	c.cmd(200, "TYPE I")
+	c.stor("STOR my file", "hello")
+	c.cmd(200, "TYPE A")
+	c.retr("my file")
+	c.list("LIST")
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected xferlog: %q", b.String())
+	}
+	// virtual paths
+	fn := "/my_file"
+
+	for i, exp := range []string{
+		"127.0.0.1 5 " + fn + " b _ i a test@example.com ftp 0 * c",
+		"127.0.0.1 5 " + fn + " a _ o a test@example.com ftp 0 * c",
+	} {
+		fs := strings.Fields(lines[i])
+		if len(fs) != 18 {
+			t.Fatalf("Unexpected xferlog line: %q", lines[i])
+		}
+		if _, err := time.Parse("Mon Jan _2 15:04:05 2006", strings.Join(fs[:5], " ")); err != nil {
+			t.Errorf("Unexpected xferlog date: %s", err)
+		}
+		if _, err := strconv.Atoi(fs[5]); err != nil {
+			t.Errorf("Unexpected xferlog duration: %s", err)
+		}
+		if s := strings.Join(fs[6:], " "); s != exp {
+			t.Errorf("Unexpected xferlog line: %q, expected %q", s, exp)
+		}
+	}
+}
+
+func TestFtpdQuota(t *testing.T) {
+	t.Chdir(t.TempDir())
+	addr := startServerWith(t, &Server{Auth: Anonymous{Write: true, Quota: 10}})
+	c := dial(t, addr)
+	c.cmd(200, "TYPE I")
+	c.stor("STOR a", "12345678")
+
+	// during the transfer
+	get := c.data()
+	c.cmd(150, "STOR b")
+	sock := get()
+	io.WriteString(sock, "12345")
+	sock.Close()
+	c.expect(552)
+	if s := readFile(t, "b"); s != "" {
+		t.Errorf("Unexpected content past the quota: %q", s)
+	}
+
+	// replacing a file frees its size
+	c.stor("STOR a", "123456789")
+	c.cmd(250, "DELE b")
+
+	// before the transfer
+	c.stor("APPE a", "0")
+	c.data()
+	c.cmd(552, "APPE a")
+	c.cmd(552, "STOU")
+
+	// deleting a file frees its size, once for all the
+	// sessions, whatever their login, the home being the
+	// same: concurrent uploads can't exceed the quota
+	c.cmd(250, "DELE a")
+	c2 := dialNoLogin(t, addr)
+	c2.cmd(331, "USER ftp")
+	c2.cmd(230, "PASS x")
+	c2.cmd(200, "TYPE I")
+	get, get2 := c.data(), c2.data()
+	c.cmd(150, "STOR a")
+	c2.cmd(150, "STOR b")
+	sock, sock2 := get(), get2()
+	io.WriteString(sock, "123456")
+	sock.Close()
+	c.expect(226)
+	io.WriteString(sock2, "123456")
+	sock2.Close()
+	c2.expect(552)
+	if s := readFile(t, "b"); s != "" {
+		t.Errorf("Unexpected content past the quota: %q", s)
+	}
+
+	// replacing a file by a rename frees its size too
+	c.cmd(350, "RNFR b")
+	c.cmd(250, "RNTO a")
+	c.stor("STOR c", "1234567890")
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(1000)
+	if newBucket(0) != nil {
+		t.Errorf("Expected no bucket without a rate")
+	}
+
+	// a second's worth at once, then as per the rate
+	start := time.Now()
+	ctx := context.Background()
+	for i := 0; i < 15; i++ {
+		if err := b.wait(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 450*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Unexpected duration: %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.wait(ctx, 1000); err != context.Canceled {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFtpdRate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("f", make([]byte, 30000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, startServerWith(t, &Server{SessionRate: 20000}))
+	c.cmd(200, "TYPE I")
+
+	start := time.Now()
+	if s := c.retr("f"); len(s) != 30000 {
+		t.Errorf("Unexpected RETR: %d bytes", len(s))
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("Transfer too fast: %s", d)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	var m MemFS
+
+	if err := m.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mkdir("/d", 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir: expected ErrExist, got %v", err)
+	}
+	if err := m.Mkdir("/nope/d", 0755); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Mkdir: expected ErrNotExist, got %v", err)
+	}
+
+	f, err := m.Create("/d/f", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "hello world")
+	f.Truncate(5)
+	f.Close()
+	if _, err := m.Create("/d/f", os.O_WRONLY|os.O_CREATE|os.O_EXCL); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create: expected ErrExist, got %v", err)
+	}
+
+	f, err = m.Create("/d/f", os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "!")
+	f.Close()
+
+	f, err = m.Open("/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(1, io.SeekStart)
+	b, _ := io.ReadAll(f)
+	if string(b) != "ello!" {
+		t.Errorf("Unexpected content: %q", b)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Write: expected ErrPermission, got %v", err)
+	}
+	f.Close()
+
+	// directories move with their content
+	if err := m.Rename("/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := m.Stat("e/f"); err != nil || fi.Size() != 6 || fi.Name() != "f" {
+		t.Errorf("Stat after Rename: %v, %v", fi, err)
+	}
+	if _, err := m.Stat("/d/f"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: expected ErrNotExist, got %v", err)
+	}
+
+	if err := m.Remove("/e"); err == nil {
+		t.Errorf("Remove: non-empty directory removed")
+	}
+	fis, err := m.ReadDir("/")
+	if err != nil || len(fis) != 1 || fis[0].Name() != "e" || !fis[0].IsDir() {
+		t.Errorf("Unexpected ReadDir: %v, %v", fis, err)
+	}
+	if err := m.Remove("/e/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("/e"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFtpdMemFS(t *testing.T) {
+	t.Chdir(t.TempDir())
+	m := &MemFS{}
+	c := dial(t, startServerWith(t, &Server{FS: m}))
+
+	c.cmd(200, "TYPE I")
+	c.cmd(257, "MKD d")
+	c.cmd(250, "CWD d")
+	c.stor("STOR f", "hello")
+	c.stor("APPE f", "!")
+	if s := c.retr("/d/f"); s != "hello!" {
+		t.Errorf("Unexpected RETR: %q", s)
+	}
+	if s := c.cmd(213, "SIZE f"); s != "6" {
+		t.Errorf("Unexpected SIZE: %s", s)
+	}
+	c.rest = 2
+	if s := c.retr("f"); s != "llo!" {
+		t.Errorf("Unexpected RETR after REST: %q", s)
+	}
+	msg := c.stor("STOU", "unique")
+	fn, _ := strings.CutPrefix(msg, "FILE: ")
+
+	if ls := c.list("NLST"); !slices.Equal(ls, []string{"f", fn}) {
+		t.Errorf("Unexpected NLST: %q", ls)
+	}
+
+	c.cmd(350, "RNFR f")
+	c.cmd(250, "RNTO /g")
+	c.cmd(250, "DELE %s", fn)
+	c.cmd(250, "CDUP")
+	c.cmd(250, "RMD d")
+
+	// nothing on disk
+	if xs, _ := os.ReadDir("."); len(xs) != 0 {
+		t.Errorf("Unexpected files on disk: %v", xs)
+	}
+	fis, err := m.ReadDir("/")
+	if err != nil || len(fis) != 1 || fis[0].Name() != "g" || fis[0].Size() != 6 {
+		t.Errorf("Unexpected content: %v, %v", fis, err)
+	}
+}
+
+func TestFtpdReadOnly(t *testing.T) {
+	fsys := fstest.MapFS{
+		"pub/f": {Data: []byte("hello"), Mode: 0644},
+	}
+	c := dial(t, startServerWith(t, &Server{FS: ReadOnly(fsys)}))
+
+	c.cmd(200, "TYPE I")
+	if ls := c.list("NLST pub"); !slices.Equal(ls, []string{"f"}) {
+		t.Errorf("Unexpected NLST: %q", ls)
+	}
+	c.rest = 1
+	if s := c.retr("pub/f"); s != "ello" {
+		t.Errorf("Unexpected RETR: %q", s)
+	}
+
+	c.data()
+	if s := c.cmd(553, "STOR pub/g"); s != "pub/g: Permission denied" {
+		t.Errorf("Unexpected STOR reply: %s", s)
+	}
+	c.cmd(550, "MKD d")
+	c.cmd(550, "DELE pub/f")
+	c.cmd(350, "RNFR pub/f")
+	c.cmd(553, "RNTO g")
+}
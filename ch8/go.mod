@@ -2,4 +2,7 @@ module depth-limited-crawler
 
 go 1.22.6
 
-require golang.org/x/net v0.28.0 // indirect
+require (
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0 // indirect
+)